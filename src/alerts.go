@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	ntopng_active_alerts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntopng_active_alerts",
+		Help: "Number of engaged ntopng alerts on the interface, by severity.",
+	}, []string{"hostname", "ifid", "severity"}) // labels for the metrics
+)
+
+const endpointAlerts = "alerts"
+
+// maxAlertsPerInterface is how many engaged alerts we ask ntopng to list per
+// interface. Past that the counts are a lower bound.
+const maxAlertsPerInterface = 1000
+
+// alertSeverities are ntopng's alert severities by their numeric value. Every
+// one of them is exported, at 0 when there are no such alerts, so alerting
+// rules on ntopng_active_alerts resolve when the alerts do.
+var alertSeverities = map[int64]string{
+	1: "debug",
+	2: "info",
+	3: "notice",
+	4: "warning",
+	5: "error",
+	6: "critical",
+	7: "alert",
+	8: "emergency",
+}
+
+func queryNtopActiveAlerts(c config, ifid int) (string, error) {
+	// https://www.ntop.org/guides/ntopng/api/rest/api_v2.html (alerts)
+	params := url.Values{}
+	params.Set("ifid", strconv.Itoa(ifid))
+	params.Set("status", "engaged")
+	params.Set("start", "0")
+	params.Set("length", strconv.Itoa(maxAlertsPerInterface))
+
+	var url = ntopngAPIURL(c, "/get/interface/alert/list.lua", params)
+
+	req, _ := http.NewRequest("GET", url, nil)
+
+	req.Header.Set("Authorization", "Basic "+c.basicAuthenticationToken)
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := doNtopRequest(req, endpointAlerts)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponseBody(resp, c.maxResponseBytes, endpointAlerts)
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// alertSeverity returns the severity of an alert record. ntopng reports it
+// either as an object with a numeric value and a label or, in older releases,
+// as a bare number. Severities we don't know are counted as unknown to keep
+// the label's values bounded.
+func alertSeverity(record gjson.Result) string {
+	severity := record.Get("severity")
+	if severity.IsObject() {
+		severity = severity.Get("value")
+	}
+	if name, ok := alertSeverities[severity.Int()]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// scrapeAlerts exports the number of engaged alerts on ifid by severity. Like
+// hosts, alerts are best effort: failures are logged and the interface's alert
+// series are left as they were.
+func scrapeAlerts(c config, hostname string, ifid int) {
+	body, err := queryNtopActiveAlerts(c, ifid)
+	if err != nil {
+		errorLog.Printf("alerts_error", "Error: Unable to query ntopng alerts for interface %d: %v", ifid, err)
+		return
+	}
+
+	records := gjson.Get(body, "rsp.records")
+	if !records.Exists() {
+		errorLog.Printf("alerts_no_records", "Error: ntopng alerts response for interface %d has no records. Skipping", ifid)
+		return
+	}
+
+	counts := map[string]int{"unknown": 0}
+	for _, name := range alertSeverities {
+		counts[name] = 0
+	}
+	records.ForEach(func(key, value gjson.Result) bool {
+		counts[alertSeverity(value)] += 1
+		return true // keep iterating
+	})
+
+	ifidLabel := fmt.Sprintf("%d", ifid)
+	for severity, count := range counts {
+		ntopng_active_alerts.WithLabelValues(hostname, ifidLabel, severity).Set(float64(count))
+	}
+}
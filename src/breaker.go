@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ntopng_circuit_breaker_state = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_circuit_breaker_state",
+		Help: "State of the ntopng client circuit breaker. 0 = closed, 1 = open, 2 = half-open.",
+	})
+)
+
+// errCircuitOpen is returned instead of making a request while the breaker is open
+var errCircuitOpen = errors.New("ntopng circuit breaker is open; not sending request")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker stops us hammering ntopng while it is down. After
+// failureThreshold consecutive failures across all requests the breaker opens
+// and every call fails fast for cooldown. After that a single probe request is
+// let through (half-open); if it succeeds the breaker closes again, otherwise
+// it re-opens for another cooldown.
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	failureThreshold    int
+	cooldown            time.Duration
+	consecutiveFailures int
+	state               breakerState
+	openedAt            time.Time
+	probeInFlight       bool
+	// probe numbers the half-open probes, so only the one in flight can
+	// clear probeInFlight
+	probe uint64
+}
+
+// newCircuitBreaker returns a breaker that opens after failureThreshold
+// consecutive failures. A threshold of 0 disables the breaker.
+func newCircuitBreaker(failureThreshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		state:            breakerClosed,
+	}
+}
+
+// allow reports whether a request may be sent right now. It returns
+// errCircuitOpen if the breaker is open. If the request is the half-open probe
+// it also returns the probe's number, which has to be passed back to record;
+// any other request gets 0.
+func (b *circuitBreaker) allow() (uint64, error) {
+	if b == nil || b.failureThreshold <= 0 {
+		return 0, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return 0, errCircuitOpen
+		}
+		b.setState(breakerHalfOpen)
+		return b.startProbe(), nil
+	case breakerHalfOpen:
+		// only one probe at a time while half-open
+		if b.probeInFlight {
+			return 0, errCircuitOpen
+		}
+		return b.startProbe(), nil
+	default:
+		return 0, nil
+	}
+}
+
+// startProbe must be called with b.mu held
+func (b *circuitBreaker) startProbe() uint64 {
+	b.probe += 1
+	b.probeInFlight = true
+	return b.probe
+}
+
+// record feeds the outcome of a request back into the breaker. probe is what
+// allow returned for the request. A request sent before the breaker opened can
+// finish while the probe is still out; only the probe itself decides whether
+// the breaker closes and frees the slot for the next one.
+func (b *circuitBreaker) record(probe uint64, err error) {
+	if b == nil || b.failureThreshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen && probe != b.probe {
+		return
+	}
+	b.probeInFlight = false
+
+	if err == nil {
+		b.consecutiveFailures = 0
+		if b.state != breakerClosed {
+			log.Println("ntopng circuit breaker closed; ntopng API has recovered")
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.consecutiveFailures += 1
+	if b.state == breakerHalfOpen || b.consecutiveFailures >= b.failureThreshold {
+		if b.state != breakerOpen {
+			log.Printf("ntopng circuit breaker opened after %d consecutive failures. Failing fast for %s", b.consecutiveFailures, b.cooldown)
+		}
+		b.setState(breakerOpen)
+		b.openedAt = time.Now()
+	}
+}
+
+// setState must be called with b.mu held
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	ntopng_circuit_breaker_state.Set(float64(s))
+}
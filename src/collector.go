@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+// collection modes selectable with COLLECTION_MODE
+const (
+	// collectionModePoll scrapes ntopng in the background and feeds the deltas
+	// into counters. This is the original behavior.
+	collectionModePoll = "poll"
+	// collectionModeOnDemand queries ntopng synchronously whenever Prometheus
+	// scrapes us and reports the current values as gauges.
+	collectionModeOnDemand = "ondemand"
+	// collectionModePassthrough works like collectionModeOnDemand, but exports
+	// ntopng's own counters as Prometheus counters so rate() can be applied
+	// directly.
+	collectionModePassthrough = "passthrough"
+)
+
+// ntopngCollector is a prometheus.Collector that queries ntopng while
+// Prometheus is scraping /metrics. Because it reports ntopng's own values
+// there is no counter-delta bookkeeping, and nothing goes stale between
+// scrapes. They are exported as gauges, or in passthrough mode as counters
+// where ntopng keeps a counter.
+type ntopngCollector struct {
+	conf        config
+	interfaces  []int
+	descs       map[string]*prometheus.Desc
+	valueTypes  map[string]prometheus.ValueType
+	metricNames []string
+	// lastSucceeded is whether the last Collect scraped enough interfaces to
+	// count as successful, as for a poll mode cycle
+	lastSucceeded atomic.Bool
+}
+
+func newNtopngCollector(conf config, interfaces []int) *ntopngCollector {
+	descs := make(map[string]*prometheus.Desc)
+	valueTypes := make(map[string]prometheus.ValueType)
+	var metricNames []string
+	for metricName, metric := range zmqMetrics {
+		if conf.disabledMetrics[metricName] {
+			continue
+		}
+		metricNames = append(metricNames, metricName)
+
+		name := "ntopng_" + metricName
+		valueTypes[metricName] = prometheus.GaugeValue
+		if conf.collectionMode == collectionModePassthrough {
+			if metricType(conf, metricName, metric.defaultType()) == metricTypeCounter {
+				name += "_total"
+				valueTypes[metricName] = prometheus.CounterValue
+			}
+		}
+
+		descs[metricName] = prometheus.NewDesc(
+			name,
+			metricHelp(conf, metricName),
+			[]string{"hostname", "ifid"}, nil,
+		)
+	}
+
+	sort.Strings(metricNames)
+
+	return &ntopngCollector{
+		conf:        conf,
+		interfaces:  interfaces,
+		descs:       descs,
+		valueTypes:  valueTypes,
+		metricNames: metricNames,
+	}
+}
+
+func (n *ntopngCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range n.descs {
+		ch <- desc
+	}
+}
+
+func (n *ntopngCollector) Collect(ch chan<- prometheus.Metric) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Println("oh no. Unable to detect what your hostname is :shrug:")
+	}
+
+	var scrapedInterfaces int
+	defer func() {
+		n.lastSucceeded.Store(cycleSucceeded(scrapedInterfaces, len(n.interfaces), n.conf.minSuccessFraction))
+	}()
+
+	for _, ifid := range n.interfaces {
+		// a single attempt per scrape; Prometheus will simply try again next
+		// time, and retrying here would just make the scrape time out
+		body, err := queryNtopMetricsWithRetries(n.conf, ifid)
+		if err != nil {
+			errorLog.Printf("interface_data_error", "oh no. error hitting ntopng api for metrics data for interface %d! %v", ifid, err)
+			reason := "request"
+			if errors.Is(err, errNotJSON) {
+				reason = "not_json"
+			}
+			ntopng_scrape_errors.WithLabelValues(fmt.Sprintf("%d", ifid), reason).Inc()
+			skipInterface(ifid, reason, err)
+			continue
+		}
+
+		rc := gjson.Get(body, "rc")
+		if rc.Exists() && rc.Int() != 0 {
+			errorLog.Printf("interface_data_rc", "Error: ntopng returned rc=%d (%s) for interface %d. Skipping interface", rc.Int(), gjson.Get(body, "rc_str").String(), ifid)
+			ntopng_scrape_errors.WithLabelValues(fmt.Sprintf("%d", ifid), "rc").Inc()
+			skipInterface(ifid, "rc", nil)
+			continue
+		}
+
+		if !checkSchema(n.conf, body, ifid, n.metricNames) {
+			continue
+		}
+
+		setInterfaceUp(ifid, true)
+		scrapedInterfaces += 1
+
+		scraped := make(map[string]float64)
+		for metricName, desc := range n.descs {
+			val, metricPath := lookupStat(body, n.conf.statsBasePath, metricField(n.conf, metricName))
+			if !val.Exists() {
+				errorLog.Printf("missing_field", "Error: %s missing from ntopng response for interface %d. Skipping metric", metricPath, ifid)
+				ntopng_scrape_errors.WithLabelValues(fmt.Sprintf("%d", ifid), "missing_field").Inc()
+				continue
+			}
+
+			scraped[metricName] = val.Float()
+			value := val.Float()
+			if n.valueTypes[metricName] == prometheus.GaugeValue {
+				value = roundValue(n.conf, metricName, value)
+			}
+			ch <- prometheus.MustNewConstMetric(desc, n.valueTypes[metricName], value, hostname, fmt.Sprintf("%d", ifid))
+		}
+
+		if n.conf.enableStatsJSON {
+			setLatestStats(ifid, scraped)
+		}
+	}
+}
+
+// startOnDemandCollector enumerates the ntopng interfaces and then registers
+// and returns an ntopngCollector for them. It runs in its own goroutine so the
+// metrics endpoint is up while we wait on ntopng.
+func startOnDemandCollector(conf config, registry prometheus.Registerer) *ntopngCollector {
+	interfaces, err := enumerateInterfaceIDs(conf)
+	for err == nil && len(interfaces) == 0 {
+		reportZeroInterfaces(conf, enumerationRetryInterval)
+		time.Sleep(enumerationRetryInterval)
+		interfaces, err = enumerateInterfaceIDs(conf)
+	}
+	if err != nil {
+		log.Println("oh no. error hitting ntopng api for interface data!")
+	}
+
+	interfaces = capInterfaces(interfaces, conf.maxInterfaces)
+
+	if len(interfaces) > 0 {
+		publishNtopngVersion(conf, interfaces[0])
+	}
+
+	collector := newNtopngCollector(conf, interfaces)
+	mustRegister(registry, collector)
+	if len(interfaces) > 0 {
+		exporterReady.Store(true)
+	}
+	return collector
+}
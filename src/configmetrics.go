@@ -0,0 +1,67 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// the ntopng_config_* gauges mirror the effective configuration so
+// misconfigured exporters can be found from Prometheus. They are set once at
+// startup.
+var (
+	ntopng_config_scrape_interval = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_config_scrape_interval_seconds",
+		Help: "Time the scraper waits between scrape cycles. Only meaningful in poll mode.",
+	})
+	ntopng_config_max_retries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_config_max_retries",
+		Help: "Number of attempts made for a single ntopng call before giving up.",
+	})
+	ntopng_config_retry_deadline = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_config_retry_deadline_seconds",
+		Help: "NTOPNG_RETRY_DEADLINE_SECONDS. 0 means retries are only bounded by count.",
+	})
+	ntopng_config_attempt_timeout = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_config_attempt_timeout_seconds",
+		Help: "NTOPNG_ATTEMPT_TIMEOUT_SECONDS. 0 means individual requests to ntopng don't time out.",
+	})
+	ntopng_config_breaker_failure_threshold = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_config_breaker_failure_threshold",
+		Help: "NTOPNG_BREAKER_FAILURE_THRESHOLD. 0 means the circuit breaker is disabled.",
+	})
+	ntopng_config_breaker_cooldown = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_config_breaker_cooldown_seconds",
+		Help: "NTOPNG_BREAKER_COOLDOWN_SECONDS.",
+	})
+	ntopng_config_max_interfaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_config_max_interfaces",
+		Help: "MAX_INTERFACES. 0 means the number of scraped interfaces is not capped.",
+	})
+	ntopng_config_max_requests_per_second = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_config_max_requests_per_second",
+		Help: "NTOPNG_MAX_RPS. 0 means requests to ntopng are not rate limited.",
+	})
+)
+
+// registerConfigMetrics registers the ntopng_config_* gauges and sets them
+// from conf.
+func registerConfigMetrics(registry prometheus.Registerer, conf config) {
+	ntopng_config_scrape_interval.Set(scrapeInterval.Seconds())
+	ntopng_config_max_retries.Set(maxRetries)
+	ntopng_config_retry_deadline.Set(conf.retryDeadline.Seconds())
+	ntopng_config_attempt_timeout.Set(conf.attemptTimeout.Seconds())
+	ntopng_config_breaker_failure_threshold.Set(float64(conf.breakerFailureThreshold))
+	ntopng_config_breaker_cooldown.Set(conf.breakerCooldown.Seconds())
+	ntopng_config_max_interfaces.Set(float64(conf.maxInterfaces))
+	ntopng_config_max_requests_per_second.Set(conf.maxRequestsPerSecond)
+
+	mustRegister(registry,
+		ntopng_config_scrape_interval,
+		ntopng_config_max_retries,
+		ntopng_config_retry_deadline,
+		ntopng_config_attempt_timeout,
+		ntopng_config_breaker_failure_threshold,
+		ntopng_config_breaker_cooldown,
+		ntopng_config_max_interfaces,
+		ntopng_config_max_requests_per_second,
+	)
+}
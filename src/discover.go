@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/tidwall/gjson"
+)
+
+// discoverFields prints every numeric leaf under rsp in the first interface's
+// data.lua response as "<gjson path> <value>", sorted by path. It is the
+// catalog behind --discover, for finding fields to scrape or map without
+// reading the ntopng source.
+func discoverFields(c config, out io.Writer) error {
+	// like /selftest, leave the interface names and circuit breaker alone
+	interfaces, names, err := listInterfaces(c, nil)
+	if err != nil {
+		return fmt.Errorf("enumerating interfaces: %w", err)
+	}
+	if len(interfaces) == 0 {
+		return fmt.Errorf("ntopng reported no interfaces")
+	}
+
+	ifid := interfaces[0]
+	body, err := queryInterfaceData(c, ifid, nil)
+	if err != nil {
+		return fmt.Errorf("querying interface %d: %w", ifid, err)
+	}
+
+	leaves := make(map[string]string)
+	collectNumericLeaves(gjson.Get(body, "rsp"), "rsp", leaves)
+
+	paths := make([]string, 0, len(leaves))
+	for path := range leaves {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	fmt.Fprintf(out, "# numeric fields in data.lua for interface %d (%s)\n", ifid, names[ifid])
+	for _, path := range paths {
+		fmt.Fprintln(out, path, leaves[path])
+	}
+
+	return nil
+}
+
+// collectNumericLeaves walks value and records the raw JSON of every number
+// under it, keyed by its gjson path. Keys containing gjson metacharacters are
+// escaped, so that with the NTOPNG_STATS_BASE_PATH prefix dropped a path can
+// be used as a metric mapping field as-is.
+func collectNumericLeaves(value gjson.Result, path string, leaves map[string]string) {
+	switch {
+	case value.Type == gjson.Number:
+		leaves[path] = value.Raw
+	case value.IsObject() || value.IsArray():
+		value.ForEach(func(key, child gjson.Result) bool {
+			collectNumericLeaves(child, path+"."+escapeGjsonKey(key.String()), leaves)
+			return true // keep iterating
+		})
+	}
+}
+
+func escapeGjsonKey(key string) string {
+	var escaped []rune
+	for _, r := range key {
+		switch r {
+		case '.', '*', '?', '|', '#', '@', '\\':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, r)
+	}
+	return string(escaped)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	ntopng_host_bytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntopng_host_bytes",
+		Help: "Bytes sent or received by an active host, as reported by ntopng. Only the top MAX_HOSTS hosts by traffic are exported per interface.",
+	}, []string{"hostname", "ifid", "host", "direction"}) // labels for the metrics
+)
+
+const endpointHosts = "hosts"
+
+// hostSeries identifies one ntopng_host_bytes series of an interface
+type hostSeries struct {
+	host      string
+	direction string
+}
+
+// exportedHosts holds the ntopng_host_bytes series the last scrapeHosts set
+// for each ifid, so the next one can delete just those of hosts that dropped
+// out. Only the scraper goroutine touches it.
+var exportedHosts = make(map[int]map[hostSeries]bool)
+
+func queryNtopActiveHosts(c config, ifid int) (string, error) {
+	// https://www.ntop.org/guides/ntopng/api/rest/api_v2.html (host)
+	// ask for the busiest hosts first so MAX_HOSTS keeps the top talkers
+	params := url.Values{}
+	params.Set("ifid", strconv.Itoa(ifid))
+	params.Set("currentPage", "1")
+	params.Set("perPage", strconv.Itoa(c.maxHosts))
+	params.Set("sortColumn", "column_traffic")
+	params.Set("sortOrder", "desc")
+
+	var url = ntopngAPIURL(c, "/get/host/active.lua", params)
+
+	req, _ := http.NewRequest("GET", url, nil)
+
+	req.Header.Set("Authorization", "Basic "+c.basicAuthenticationToken)
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := doNtopRequest(req, endpointHosts)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponseBody(resp, c.maxResponseBytes, endpointHosts)
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// scrapeHosts exports the byte counts of the top MAX_HOSTS active hosts on
+// ifid. Like timeseries, hosts are best effort: failures are logged and the
+// interface's host series are left as they were.
+func scrapeHosts(c config, hostname string, ifid int) {
+	body, err := queryNtopActiveHosts(c, ifid)
+	if err != nil {
+		errorLog.Printf("hosts_error", "Error: Unable to query ntopng active hosts for interface %d: %v", ifid, err)
+		return
+	}
+
+	hosts := gjson.Get(body, "rsp.data")
+	if !hosts.Exists() {
+		errorLog.Printf("hosts_no_data", "Error: ntopng active hosts response for interface %d has no data. Skipping", ifid)
+		return
+	}
+
+	ifidLabel := fmt.Sprintf("%d", ifid)
+	current := make(map[hostSeries]bool)
+
+	var exported int
+	hosts.ForEach(func(key, value gjson.Result) bool {
+		if exported >= c.maxHosts {
+			return false
+		}
+
+		host := value.Get("ip").String()
+		if host == "" {
+			return true
+		}
+		// the same address on different VLANs is a different host to ntopng
+		if vlan := value.Get("vlan").Int(); vlan != 0 {
+			host = fmt.Sprintf("%s@%d", host, vlan)
+		}
+
+		for _, direction := range []string{"sent", "recvd"} {
+			val := value.Get("bytes." + direction)
+			if val.Exists() {
+				ntopng_host_bytes.WithLabelValues(hostname, ifidLabel, host, direction).Set(val.Float())
+				current[hostSeries{host: host, direction: direction}] = true
+			}
+		}
+		exported += 1
+		return true // keep iterating
+	})
+
+	// hosts come and go, so drop the series of hosts that are no longer in the
+	// top MAX_HOSTS rather than leaving them stale. The new values are set
+	// first so a scrape of /metrics in between never sees the interface
+	// without hosts.
+	for series := range exportedHosts[ifid] {
+		if !current[series] {
+			ntopng_host_bytes.DeleteLabelValues(hostname, ifidLabel, series.host, series.direction)
+		}
+	}
+	exportedHosts[ifid] = current
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// activeHostsBody returns an active.lua response listing hosts with the given
+// bytes sent and received
+func activeHostsBody(hosts map[string]int) string {
+	var data string
+	for ip, bytes := range hosts {
+		if data != "" {
+			data += ","
+		}
+		data += fmt.Sprintf(`{"ip":%q,"vlan":0,"bytes":{"sent":%d,"recvd":%d}}`, ip, bytes, bytes)
+	}
+	return fmt.Sprintf(`{"rc":0,"rc_str":"OK","rsp":{"data":[%s]}}`, data)
+}
+
+func TestScrapeHostsDeletesStaleHosts(t *testing.T) {
+	// 10.0.0.1 drops out of the top hosts in the second scrape
+	responses := []string{
+		activeHostsBody(map[string]int{"10.0.0.1": 100, "10.0.0.2": 200}),
+		activeHostsBody(map[string]int{"10.0.0.2": 300, "10.0.0.3": 50}),
+	}
+	var scrapes atomic.Int64
+	conf, _ := newFakeNtopng(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := scrapes.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(responses[min(int(n), len(responses))-1]))
+	}))
+	conf.maxHosts = 10
+	ntopng_host_bytes.Reset()
+	t.Cleanup(func() {
+		ntopng_host_bytes.Reset()
+		delete(exportedHosts, 0)
+	})
+
+	scrapeHosts(conf, "test", 0)
+	scrapeHosts(conf, "test", 0)
+
+	if n := testutil.CollectAndCount(ntopng_host_bytes); n != 4 {
+		t.Errorf("ntopng_host_bytes has %d series, want 4 for the two current hosts", n)
+	}
+	if got := testutil.ToFloat64(ntopng_host_bytes.WithLabelValues("test", "0", "10.0.0.2", "sent")); got != 300 {
+		t.Errorf("bytes sent by 10.0.0.2 = %v, want 300", got)
+	}
+	if ntopng_host_bytes.DeleteLabelValues("test", "0", "10.0.0.1", "sent") {
+		t.Error("10.0.0.1 is still exported after dropping out of the top hosts")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// logSampler rate limits repetitive log lines. The first occurrence of a key
+// is logged, then at most one per interval; the next line that does get
+// logged says how many were suppressed in between. A nil sampler or an
+// interval of 0 logs everything.
+type logSampler struct {
+	mu         sync.Mutex
+	interval   time.Duration
+	lastLogged map[string]time.Time
+	suppressed map[string]int
+}
+
+func newLogSampler(interval time.Duration) *logSampler {
+	return &logSampler{
+		interval:   interval,
+		lastLogged: make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+}
+
+// Printf logs like log.Printf unless a line with the same key was logged
+// within the sampling interval.
+func (s *logSampler) Printf(key string, format string, v ...any) {
+	if s == nil || s.interval <= 0 {
+		log.Printf(format, v...)
+		return
+	}
+
+	s.mu.Lock()
+	last, seen := s.lastLogged[key]
+	if seen && time.Since(last) < s.interval {
+		s.suppressed[key] += 1
+		s.mu.Unlock()
+		return
+	}
+	suppressed := s.suppressed[key]
+	s.lastLogged[key] = time.Now()
+	s.suppressed[key] = 0
+	s.mu.Unlock()
+
+	msg := fmt.Sprintf(format, v...)
+	if suppressed > 0 {
+		msg += fmt.Sprintf(" (%d similar messages suppressed)", suppressed)
+	}
+	log.Print(msg)
+}
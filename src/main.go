@@ -1,160 +1,2432 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"math"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tidwall/gjson"
+	"golang.org/x/time/rate"
 )
 
-// prometheus metric definitions
+// zmqMetric describes one value we scrape from ntopng. field is a gjson path
+// relative to NTOPNG_STATS_BASE_PATH and may be dotted to reach into nested
+// objects, e.g. "counters.foo". name and help are the defaults for the metric
+// it is exported as; field and help can be overridden in METRIC_MAPPING_FILE.
+// registerMetrics() builds counter or gauge from them, depending on
+// defaultType() and the type METRIC_MAPPING_FILE sets. raw is built too when
+// EXPORT_RAW_VALUES is set.
+type zmqMetric struct {
+	field   string
+	name    string
+	help    string
+	counter *prometheus.CounterVec
+	gauge   *prometheus.GaugeVec
+	// raw is the value ntopng last reported, exported as <name>_raw for
+	// debugging the counter-delta logic. nil unless EXPORT_RAW_VALUES is set.
+	raw *prometheus.GaugeVec
+	// monotonic is set for fields ntopng itself keeps as counters. They are
+	// exported as counters by default; the rest, which can go down, as gauges.
+	monotonic bool
+}
+
+// defaultType is the type m is exported as in poll and passthrough mode unless
+// METRIC_MAPPING_FILE says otherwise
+func (m *zmqMetric) defaultType() string {
+	if m.monotonic {
+		return metricTypeCounter
+	}
+	return metricTypeGauge
+}
+
+// zmqMetrics maps the names of the metrics we scrape from ntopng to where they
+// live in the response and the counters or gauges they are exported as.
+// zmq_msg_rcvd, dropped_flows and zmq_msg_drops are counters in ntopng and
+// are counters here. zmq_avg_msg_flows is an average that goes up and down,
+// so it is a gauge.
+// registerMetrics() skips any listed in DISABLED_METRICS so they never show up
+// on /metrics.
+var zmqMetrics = map[string]*zmqMetric{
+	"zmq_msg_rcvd": {
+		field:     "zmq_msg_rcvd",
+		name:      "nettel_zmq_rcvd_messages",
+		help:      "Count of zmq messages received by ntopng.",
+		monotonic: true,
+	},
+	"dropped_flows": {
+		field:     "dropped_flows",
+		name:      "nettel_flow_drops",
+		help:      "Count of flow records dropped by ntopng.",
+		monotonic: true,
+	},
+	"zmq_msg_drops": {
+		field:     "zmq_msg_drops",
+		name:      "nettel_zmq_msg_drops",
+		help:      "Count of zmq messages dropped by ntopng.",
+		monotonic: true,
+	},
+	"zmq_avg_msg_flows": {
+		field: "zmq_avg_msg_flows",
+		name:  "nettel_zmq_avg_msg_perflows",
+		help:  "Average zmq messages per flow as reported by ntopng.",
+	},
+}
+
 var (
-	nettel_zmq_rcvd_messages = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "nettel_zmq_rcvd_messages",
-		Help: "Count of gcpnettel zmq messages received.",
+	ntopng_zmq_msg_per_flow = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntopng_zmq_msg_per_flow",
+		Help: "Ratio of zmq messages received to flows, computed from ntopng's raw zmq_msg_rcvd and flows counters.",
 	}, []string{"hostname", "ifid"}) // labels for the metrics
 )
 
-var (
-	nettel_flow_drops = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "nettel_flow_drops",
-		Help: "Count of gcpnettel netflow record drops.",
-	}, []string{"hostname", "ifid"}) // labels for the metrics
-)
+var (
+	ntopng_metric_rate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntopng_metric_rate_per_second",
+		Help: "Per-second rate of an ntopng counter between the last two scrape cycles. A convenience for eyeballing; prefer rate() for alerting.",
+	}, []string{"hostname", "ifid", "metric"}) // labels for the metrics
+)
+
+var (
+	ntopng_scrape_overruns = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntopng_scrape_overruns_total",
+		Help: "Count of scrape cycles that took longer than the scrape interval.",
+	})
+)
+
+var (
+	ntopng_scraped_interfaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_scraped_interfaces",
+		Help: "Number of ntopng interfaces scraped successfully in the last scrape cycle.",
+	})
+)
+
+var (
+	ntopng_exporter_start_time = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_exporter_start_time_seconds",
+		Help: "Unix time the exporter started at.",
+	})
+)
+
+var (
+	ntopng_interfaces_skipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_interfaces_skipped_total",
+		Help: "Count of times an ntopng interface was skipped for a cycle, by reason.",
+	}, []string{"ifid", "reason"}) // labels for the metrics
+)
+
+var (
+	ntopng_failed_interfaces = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_failed_interfaces",
+		Help: "Number of ntopng interfaces whose scrape failed in the last scrape cycle.",
+	})
+)
+
+var (
+	ntopng_last_successful_cycle = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_last_successful_cycle_timestamp_seconds",
+		Help: "Unix time of the last scrape cycle in which at least MIN_INTERFACE_SUCCESS_FRACTION of the interfaces were scraped successfully.",
+	})
+)
+
+var (
+	ntopng_scraper_panics = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntopng_scraper_panics_total",
+		Help: "Count of scrape cycles aborted by a panic. The scraper recovers and continues with the next cycle.",
+	})
+)
+
+var (
+	ntopng_scrape_cycle_duration_avg = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_scrape_cycle_duration_avg_seconds",
+		Help: "Exponentially weighted moving average of scrape cycle durations. Compare against ntopng_config_scrape_interval_seconds.",
+	})
+)
+
+// rateMetrics are the zmqMetrics we also export a per-second rate for
+var rateMetrics = map[string]bool{
+	"zmq_msg_rcvd":  true,
+	"dropped_flows": true,
+}
+
+var (
+	ntopng_api_responses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_api_responses_total",
+		Help: "Count of ntopng API responses by HTTP status code and endpoint.",
+	}, []string{"code", "endpoint"}) // labels for the metrics
+)
+
+var (
+	ntopng_schema_violations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_schema_violations_total",
+		Help: "Count of expected fields missing from ntopng responses while STRICT_SCHEMA is set.",
+	}, []string{"field"}) // labels for the metrics
+)
+
+// ntopng_api_request_duration is built by registerMetrics(), since whether it
+// uses native histograms depends on ENABLE_NATIVE_HISTOGRAMS
+var ntopng_api_request_duration *prometheus.HistogramVec
+
+// nativeHistogramBucketFactor is the growth factor between native histogram
+// buckets. 1.1 is the value suggested by client_golang.
+const nativeHistogramBucketFactor = 1.1
+
+var (
+	ntopng_api_response_bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_api_response_bytes_total",
+		Help: "Count of response body bytes read from the ntopng API, by endpoint.",
+	}, []string{"endpoint"}) // labels for the metrics
+)
+
+var (
+	ntopng_api_auth_failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_api_auth_failures_total",
+		Help: "Count of ntopng API requests rejected with 401 or 403.",
+	}, []string{"endpoint"}) // labels for the metrics
+)
+
+var (
+	ntopng_api_retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_api_retries_total",
+		Help: "Count of retries issued against the ntopng API.",
+	}, []string{"endpoint"}) // labels for the metrics
+)
+
+var (
+	ntopng_retry_reasons = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_retry_reasons_total",
+		Help: "Count of retries issued against the ntopng API, by the kind of failure that caused them.",
+	}, []string{"reason"}) // labels for the metrics
+)
+
+var (
+	ntopng_api_recoveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_api_recoveries_total",
+		Help: "Count of ntopng API calls that succeeded after one or more retries.",
+	}, []string{"endpoint"}) // labels for the metrics
+)
+
+var (
+	ntopng_empty_enumerations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntopng_empty_enumerations_total",
+		Help: "Count of interface enumerations that succeeded but found no ntopng interfaces to scrape.",
+	})
+)
+
+var (
+	ntopng_interfaces_dropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntopng_interfaces_dropped_total",
+		Help: "Count of ntopng interfaces not scraped because MAX_INTERFACES was exceeded.",
+	})
+)
+
+var (
+	ntopng_interface_up = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntopng_interface_up",
+		Help: "1 if the last scrape of the ntopng interface succeeded, 0 if it failed.",
+	}, []string{"ifid", "ifname", "ifname_raw"}) // labels for the metrics
+)
+
+var (
+	ntopng_last_scrape_error = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntopng_last_scrape_error",
+		Help: "Always 1 while the last scrape of the ntopng interface failed. The error label says why; cleared once the interface is scraped successfully.",
+	}, []string{"ifid", "error"}) // labels for the metrics
+)
+
+var (
+	ntopng_info = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntopng_info",
+		Help: "Always 1. The version label reports the ntopng version the exporter is talking to.",
+	}, []string{"version"}) // labels for the metrics
+)
+
+var (
+	ntopng_counter_resets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_counter_resets_total",
+		Help: "Count of ntopng counter resets detected. Frequent resets usually mean ntopng is restarting or the zmq collector is flapping.",
+	}, []string{"metric", "ifid"}) // labels for the metrics
+)
+
+var (
+	ntopng_scraper_running = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntopng_scraper_running",
+		Help: "1 while the ntopng scraper loop is running, 0 once it has exited.",
+	})
+)
+
+var (
+	ntopng_scrape_errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntopng_scrape_errors_total",
+		Help: "Count of per-interface scrapes that were skipped because of an error.",
+	}, []string{"ifid", "reason"}) // labels for the metrics
+)
+
+// metricHelp returns the help text for metricName, preferring an override from
+// METRIC_MAPPING_FILE
+func metricHelp(conf config, metricName string) string {
+	if mapping, ok := conf.metricMappings[metricName]; ok && mapping.Help != "" {
+		return mapping.Help
+	}
+	return zmqMetrics[metricName].help
+}
+
+// metricField returns the gjson path metricName is read from, preferring an
+// override from METRIC_MAPPING_FILE
+func metricField(conf config, metricName string) string {
+	if mapping, ok := conf.metricMappings[metricName]; ok && mapping.Field != "" {
+		return mapping.Field
+	}
+	return zmqMetrics[metricName].field
+}
+
+// roundValue rounds val to the precision METRIC_MAPPING_FILE sets for
+// metricName. val is returned as is if no precision is set.
+func roundValue(conf config, metricName string, val float64) float64 {
+	mapping, ok := conf.metricMappings[metricName]
+	if !ok || mapping.Precision == nil {
+		return val
+	}
+	scale := math.Pow(10, float64(*mapping.Precision))
+	return math.Round(val*scale) / scale
+}
+
+// metricType returns the type METRIC_MAPPING_FILE sets for metricName, or def
+// if it doesn't set one
+func metricType(conf config, metricName string, def string) string {
+	if mapping, ok := conf.metricMappings[metricName]; ok && mapping.Type != "" {
+		return mapping.Type
+	}
+	return def
+}
+
+// fqNameRE pulls the metric name out of a prometheus.Desc's String()
+var fqNameRE = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// mustRegister registers each collector with registry. Unlike
+// registry.MustRegister it exits with a message naming the metric that could
+// not be registered, e.g. because a metric mapping produced a duplicate name,
+// instead of panicking.
+func mustRegister(registry prometheus.Registerer, cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := registry.Register(c); err != nil {
+			log.Fatalf("Unable to register metric %s: %v", collectorMetricNames(c), err)
+		}
+	}
+}
+
+// collectorMetricNames returns the names of the metrics c describes
+func collectorMetricNames(c prometheus.Collector) string {
+	descs := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(descs)
+		close(descs)
+	}()
+
+	var names []string
+	for desc := range descs {
+		if match := fqNameRE.FindStringSubmatch(desc.String()); match != nil {
+			names = append(names, match[1])
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// registerMetrics registers every collector the exporter publishes with
+// registry. We use our own registry rather than the global default one so
+// that what ends up on /metrics is explicit and can be inspected in isolation.
+func registerMetrics(registry prometheus.Registerer, conf config) {
+	if !conf.disableGoCollector {
+		mustRegister(registry, collectors.NewGoCollector())
+	}
+	if !conf.disableProcessCollector {
+		mustRegister(registry, collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+
+	// these are only fed by the background scraper. In on-demand mode the
+	// ntopngCollector reports the zmq stats itself.
+	if conf.collectionMode == collectionModePoll {
+		for metricName, metric := range zmqMetrics {
+			if conf.disabledMetrics[metricName] {
+				log.Println("Metric disabled:", metricName)
+				continue
+			}
+			if metricType(conf, metricName, metric.defaultType()) == metricTypeGauge {
+				metric.gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+					Name: metric.name,
+					Help: metricHelp(conf, metricName),
+				}, []string{"hostname", "ifid"}) // labels for the metrics
+				mustRegister(registry, metric.gauge)
+			} else {
+				metric.counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+					Name: metric.name,
+					Help: metricHelp(conf, metricName),
+				}, []string{"hostname", "ifid"}) // labels for the metrics
+				mustRegister(registry, metric.counter)
+			}
+
+			if conf.exportRawValues {
+				metric.raw = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+					Name: metric.name + "_raw",
+					Help: "Value ntopng last reported for " + metric.name + ", before counter-delta and reset handling.",
+				}, []string{"hostname", "ifid"}) // labels for the metrics
+				mustRegister(registry, metric.raw)
+			}
+		}
+
+		mustRegister(registry,
+			ntopng_zmq_msg_per_flow,
+			ntopng_metric_rate,
+			ntopng_scraper_running,
+			ntopng_counter_resets,
+			ntopng_scrape_overruns,
+			ntopng_scrape_cycle_duration_avg,
+			ntopng_scraper_panics,
+			ntopng_scraped_interfaces,
+			ntopng_failed_interfaces,
+			ntopng_last_successful_cycle,
+			ntopng_seconds_since_last_enumeration,
+		)
+	}
+
+	histogramOpts := prometheus.HistogramOpts{
+		Name: "ntopng_api_request_duration_seconds",
+		Help: "Time until ntopng API response headers were received, by endpoint.",
+	}
+	if conf.enableNativeHistograms {
+		// with no classic buckets set, only the native histogram is exposed
+		histogramOpts.NativeHistogramBucketFactor = nativeHistogramBucketFactor
+	} else {
+		histogramOpts.Buckets = prometheus.DefBuckets
+	}
+	ntopng_api_request_duration = prometheus.NewHistogramVec(histogramOpts, []string{"endpoint"}) // labels for the metrics
+
+	mustRegister(registry,
+		ntopng_api_responses,
+		ntopng_api_request_duration,
+		ntopng_api_response_bytes,
+		ntopng_api_auth_failures,
+		ntopng_api_retries,
+		ntopng_retry_reasons,
+		ntopng_api_recoveries,
+		ntopng_interfaces_dropped,
+		ntopng_empty_enumerations,
+		ntopng_interfaces_skipped,
+		ntopng_interface_up,
+		ntopng_last_scrape_error,
+		ntopng_info,
+		ntopng_exporter_start_time,
+		ntopng_scrape_errors,
+		ntopng_schema_violations,
+		ntopng_circuit_breaker_state,
+		ntopng_timeseries_latest,
+		ntopng_host_bytes,
+		ntopng_active_alerts,
+		ntopng_pushgateway_failures,
+	)
+
+	registerConfigMetrics(registry, conf)
+}
+
+// names used for the endpoint label on the ntopng api metrics
+const (
+	endpointInterfaceData = "interface_data"
+	endpointInterfaces    = "interfaces"
+)
+
+// The kinds of failure the ntopng query functions report. Errors they return
+// wrap one of these where it applies, so callers can branch with errors.Is
+// instead of inspecting status codes or error text.
+var (
+	// errAuth means ntopng rejected our credentials
+	errAuth = errors.New("ntopng rejected our credentials")
+	// errNotFound means ntopng answered 404, e.g. for an unknown ifid or an
+	// endpoint this ntopng release doesn't have
+	errNotFound = errors.New("ntopng api endpoint not found")
+	// errUpstream means ntopng answered with a 5xx status code
+	errUpstream = errors.New("ntopng api server error")
+	// errDecode means ntopng's response could not be understood
+	errDecode = errors.New("unable to decode ntopng response")
+)
+
+// errNotJSON is returned when ntopng answers with something other than JSON
+var errNotJSON = fmt.Errorf("%w: ntopng api returned a non-JSON response", errDecode)
+
+// statusError is returned when ntopng answers with a non-2xx status code
+type statusError struct {
+	statusCode int
+	url        string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("ntopng api returned HTTP %d for %s", e.statusCode, e.url)
+}
+
+// Unwrap returns the kind of failure the status code stands for, if any
+func (e *statusError) Unwrap() error {
+	switch {
+	case e.statusCode == http.StatusUnauthorized, e.statusCode == http.StatusForbidden:
+		return errAuth
+	case e.statusCode == http.StatusNotFound:
+		return errNotFound
+	case e.statusCode >= 500:
+		return errUpstream
+	default:
+		return nil
+	}
+}
+
+// isAuthFailure reports whether err is an ntopng response rejecting our
+// credentials. Retrying these is pointless until the config is fixed.
+func isAuthFailure(err error) bool {
+	return errors.Is(err, errAuth)
+}
+
+// isRetryable reports whether a failed ntopng request is worth retrying.
+// Network errors and 5xx responses are usually transient; authentication and
+// authorization failures are not, and neither is an open circuit breaker.
+func isRetryable(err error) bool {
+	if errors.Is(err, errCircuitOpen) {
+		// the breaker is already rate limiting us; sitting in a backoff loop
+		// per interface would defeat the point
+		return false
+	}
+	return !isAuthFailure(err)
+}
+
+// errReadBody is returned when reading an ntopng response body fails partway
+var errReadBody = errors.New("error reading ntopng response body")
+
+// retryReason classifies an error we are about to retry for the reason label
+// of ntopng_retry_reasons_total
+func retryReason(err error) string {
+	var netErr net.Error
+	var opErr *net.OpError
+	var se *statusError
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "dial_error"
+	case errors.Is(err, errUpstream):
+		return "status_5xx"
+	case errors.As(err, &se) && se.statusCode >= 400:
+		return "status_4xx"
+	case errors.Is(err, errReadBody):
+		return "read_error"
+	case errors.Is(err, errDecode):
+		return "decode_error"
+	case errors.Is(err, errCircuitOpen):
+		return "circuit_open"
+	default:
+		return "other"
+	}
+}
+
+func reportAuthFailure(endpoint string) {
+	ntopng_api_auth_failures.WithLabelValues(endpoint).Inc()
+	log.Printf("ERROR: ntopng API rejected our credentials on the %s endpoint (HTTP 401/403). Check NTOPNG_USERNAME and NTOPNG_PASSWORD. Not retrying.", endpoint)
+}
+
+// version is reported in the User-Agent header sent to ntopng. Override at
+// build time with -ldflags "-X main.version=..."
+var version = "1.0.0"
+
+// ntopngBreaker is shared by every request we make to ntopng. It is created in
+// main() once the config has been parsed.
+var ntopngBreaker *circuitBreaker
+
+// ntopngHTTPClient is shared by every request we make to ntopng so that
+// connections are reused. It is created in main() once the config has been
+// parsed.
+var ntopngHTTPClient *http.Client
+
+// ntopngLimiter caps the rate of requests we send to ntopng across all
+// interfaces and retries. nil means unlimited. It is created in main() once the
+// config has been parsed.
+var ntopngLimiter *rate.Limiter
+
+// ntopngAuth logs in and keeps the session cookie fresh when NTOPNG_AUTH_MODE
+// is cookie. It is nil in basic mode. It is created in main() once the config
+// has been parsed.
+var ntopngAuth *ntopngSession
+
+// ntopngAttemptTimeout bounds each individual request to ntopng, including
+// reading its body. 0 means no limit. It is set in main() once the config has
+// been parsed.
+var ntopngAttemptTimeout time.Duration
+
+// errorLog samples the error lines that repeat for every interface and retry
+// while ntopng is down. It is created in main() once the config has been
+// parsed.
+var errorLog *logSampler
+
+// struct to hold config values
+type config struct {
+	ntopngURL                *url.URL
+	apiBasePath              string
+	basicAuthenticationToken string
+	ntopngUsername           string
+	ntopngPassword           string
+	authMode                 string
+	userAgent                string
+	httpProxy                *url.URL
+	clientCertFile           string
+	clientKeyFile            string
+	maxRequestsPerSecond     float64
+	maxIdleConns             int
+	maxIdleConnsPerHost      int
+	idleConnTimeout          time.Duration
+	promListenAddress        string
+	promPort                 string
+	promEndpoint             string
+	metricsMaxInFlight       int
+	maxResponseBytes         int64
+	statsBasePath            string
+	msgPerFlowMessagesField  string
+	msgPerFlowFlowsField     string
+	timeseries               []string
+	interfaceIDs             []int
+	maxInterfaces            int
+	scrapeBatchSize          int
+	scrapeBatchGap           time.Duration
+	minSuccessFraction       float64
+	enableHostMetrics        bool
+	enableAlertMetrics       bool
+	maxHosts                 int
+	disabledMetrics          map[string]bool
+	staticLabels             prometheus.Labels
+	metricMappings           map[string]metricMapping
+	enablePprof              bool
+	enableNtopngDebug        bool
+	enableStatsJSON          bool
+	enableSelftest           bool
+	enableExemplars          bool
+	exportRawValues          bool
+	strictSchema             bool
+	enableNativeHistograms   bool
+	disableGoCollector       bool
+	disableProcessCollector  bool
+	logSampleInterval        time.Duration
+	metricsAuthUsername      string
+	metricsAuthPassword      string
+	metricsTLSCertFile       string
+	metricsTLSKeyFile        string
+	pushgatewayURL           *url.URL
+	pushgatewayJob           string
+	disableMetricsServer     bool
+	breakerFailureThreshold  int
+	breakerCooldown          time.Duration
+	retryDeadline            time.Duration
+	attemptTimeout           time.Duration
+	shutdownTimeout          time.Duration
+	drainGrace               time.Duration
+	startupEnumTimeout       time.Duration
+	startupEnumFailureMode   string
+	enumerationInterval      time.Duration
+	zeroInterfacesBehavior   string
+	collectionMode           string
+	runOnce                  bool
+	runOnceTimeout           time.Duration
+}
+
+// Prometheus types a metric can be exported as, selectable per metric in
+// METRIC_MAPPING_FILE
+const (
+	metricTypeCounter = "counter"
+	metricTypeGauge   = "gauge"
+)
+
+// metricMapping is the per-metric configuration read from METRIC_MAPPING_FILE
+type metricMapping struct {
+	// Field overrides the gjson path, relative to NTOPNG_STATS_BASE_PATH, the
+	// metric is read from
+	Field string `json:"field"`
+	// Help overrides the metric's help text
+	Help string `json:"help"`
+	// Type overrides whether the metric is exported as a counter or a gauge
+	Type string `json:"type"`
+	// Precision, if set, is the number of decimal places gauge values are
+	// rounded to
+	Precision *int `json:"precision"`
+}
+
+// maxPrecision is the most decimal places a float64 can meaningfully be
+// rounded to
+const maxPrecision = 15
+
+// readMetricMappings loads METRIC_MAPPING_FILE, a JSON object keyed by the
+// metric names listed under "Supported metrics" in the README, e.g.
+//
+//	{"zmq_msg_rcvd": {"help": "zmq messages received from our probes."}}
+func readMetricMappings(path string) (map[string]metricMapping, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := make(map[string]metricMapping)
+	err = json.Unmarshal(data, &mappings)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for metricName, mapping := range mappings {
+		if _, ok := zmqMetrics[metricName]; !ok {
+			return nil, fmt.Errorf("%s contains unknown metric %q", path, metricName)
+		}
+
+		mapping.Help, err = expandEnv(mapping.Help)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s.help: %w", path, metricName, err)
+		}
+
+		if mapping.Field != "" {
+			err = validateFieldPath(mapping.Field)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s.field %q: %w", path, metricName, mapping.Field, err)
+			}
+		}
+
+		switch mapping.Type {
+		case "", metricTypeCounter, metricTypeGauge:
+		default:
+			return nil, fmt.Errorf("%s: %s.type must be %q or %q, got %q", path, metricName, metricTypeCounter, metricTypeGauge, mapping.Type)
+		}
+
+		if mapping.Precision != nil && (*mapping.Precision < 0 || *mapping.Precision > maxPrecision) {
+			return nil, fmt.Errorf("%s: %s.precision must be between 0 and %d, got %d", path, metricName, maxPrecision, *mapping.Precision)
+		}
+		mappings[metricName] = mapping
+	}
+
+	return mappings, nil
+}
+
+// validateFieldPath checks that field is a plain gjson path: keys separated by
+// dots, none of them empty. gjson's wildcard, query and modifier characters
+// must be escaped with a backslash, since they could match several values or
+// none at all.
+func validateFieldPath(field string) error {
+	var keyLen int
+	escaped := false
+	for _, r := range field {
+		switch {
+		case escaped:
+			escaped = false
+			keyLen += 1
+		case r == '\\':
+			escaped = true
+		case r == '.':
+			if keyLen == 0 {
+				return errors.New("contains an empty key")
+			}
+			keyLen = 0
+		case strings.ContainsRune("*?|#@", r):
+			return fmt.Errorf("%q must be escaped with a backslash", r)
+		default:
+			keyLen += 1
+		}
+	}
+
+	if escaped {
+		return errors.New("ends in a backslash")
+	}
+	if keyLen == 0 {
+		return errors.New("contains an empty key")
+	}
+	return nil
+}
+
+// labelNameRE is the Prometheus label name syntax
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// exporterLabels are the label names our own metrics use. A static label with
+// one of these names would clash when the metric is registered. instance and
+// job are reserved too: Prometheus sets them on every target, and the
+// Pushgateway groups our pushes by them.
+var exporterLabels = map[string]bool{
+	"code":       true,
+	"direction":  true,
+	"endpoint":   true,
+	"error":      true,
+	"field":      true,
+	"host":       true,
+	"hostname":   true,
+	"ifid":       true,
+	"ifname":     true,
+	"ifname_raw": true,
+	"instance":   true,
+	"job":        true,
+	"metric":     true,
+	"reason":     true,
+	"schema":     true,
+	"series":     true,
+	"severity":   true,
+	"version":    true,
+}
+
+// parseStaticLabels parses STATIC_LABELS, a comma-separated list of
+// name=value pairs, into labels to attach to every metric.
+func parseStaticLabels(value string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		name, labelValue, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a name=value pair", pair)
+		}
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("%q is not a valid Prometheus label name", name)
+		}
+		if exporterLabels[name] {
+			return nil, fmt.Errorf("label %q is already used by the exporter's metrics", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("label %q is set more than once", name)
+		}
+
+		labels[name] = strings.TrimSpace(labelValue)
+	}
+
+	return labels, nil
+}
+
+// defaultNtopngPort is ntopng's own port. It is used when neither
+// NTOPNG_API_URL nor NTOPNG_API_PORT has a port and NTOPNG_API_URL is plain
+// http with no path, i.e. points straight at ntopng.
+const defaultNtopngPort = "3000"
+
+// joinHostPortURL sets the port of rawURL, bracketing IPv6 literals as needed,
+// e.g. ("http://[::1]", "3000") gives http://[::1]:3000. An empty port keeps
+// the port already in rawURL. If it has none either, defaultNtopngPort is used
+// for an http URL without a path; an https URL or one with a path is taken to
+// be a reverse proxy and left on its scheme's default port. It is an error for
+// rawURL to have a port other than port.
+func joinHostPortURL(rawURL string, port string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("%q has no host", rawURL)
+	}
+
+	if u.Port() != "" && port != "" && u.Port() != port {
+		return nil, fmt.Errorf("%q has port %s, but port %s was also given", rawURL, u.Port(), port)
+	}
+	if port == "" {
+		port = u.Port()
+	}
+	if port == "" {
+		if u.Scheme != "http" || strings.Trim(u.Path, "/") != "" {
+			return u, nil
+		}
+		port = defaultNtopngPort
+	}
+
+	u.Host = net.JoinHostPort(u.Hostname(), port)
+	return u, nil
+}
+
+// ntopngAPIURL returns the URL of an ntopng REST endpoint. path is relative to
+// NTOPNG_API_BASE_PATH, e.g. "/get/interface/data.lua". Joining with net/url
+// keeps any path already in NTOPNG_API_URL, avoids double slashes and encodes
+// params properly.
+func ntopngAPIURL(c config, path string, params url.Values) string {
+	u := c.ntopngURL.JoinPath(c.apiBasePath, path)
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// expandEnv replaces ${VAR} in a config file value with the value of the
+// environment variable and $$ with a literal $. Any other $ is kept as is, so
+// help text like "billed at $5" needs no escaping. Unlike os.ExpandEnv it
+// fails on variables that are not set instead of silently substituting an
+// empty string.
+func expandEnv(value string) (string, error) {
+	var expanded strings.Builder
+	var missing []string
+
+	for len(value) > 0 {
+		i := strings.IndexByte(value, '$')
+		if i < 0 {
+			expanded.WriteString(value)
+			break
+		}
+		expanded.WriteString(value[:i])
+		value = value[i:]
+
+		switch {
+		case strings.HasPrefix(value, "$$"):
+			expanded.WriteByte('$')
+			value = value[2:]
+		case strings.HasPrefix(value, "${"):
+			end := strings.IndexByte(value, '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", value)
+			}
+			name := value[2:end]
+			v, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			expanded.WriteString(v)
+			value = value[end+1:]
+		default:
+			expanded.WriteByte('$')
+			value = value[1:]
+		}
+	}
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("unresolved environment variables: %s", strings.Join(missing, ", "))
+	}
+
+	return expanded.String(), nil
+}
+
+// what to do when STARTUP_ENUM_TIMEOUT_SECONDS elapses without an interface list
+const (
+	startupEnumFailureExit       = "exit"
+	startupEnumFailureBackground = "background"
+)
+
+// what to do when enumeration succeeds but ntopng has no interfaces to scrape,
+// selectable with ZERO_INTERFACES_BEHAVIOR
+const (
+	zeroInterfacesWait = "wait"
+	zeroInterfacesFail = "fail"
+)
+
+// redacted stands in for credentials when the config is printed
+const redacted = "REDACTED"
+
+// MarshalJSON renders the resolved config for --print-config. Credentials are
+// redacted so the output is safe to diff and store in deployment pipelines.
+func (c config) MarshalJSON() ([]byte, error) {
+	var httpProxy string
+	if c.httpProxy != nil {
+		httpProxy = c.httpProxy.Redacted()
+	}
+
+	var pushgatewayURL string
+	if c.pushgatewayURL != nil {
+		pushgatewayURL = c.pushgatewayURL.Redacted()
+	}
+
+	timeseries := []string{}
+	timeseries = append(timeseries, c.timeseries...)
+	interfaceIDs := []int{}
+	interfaceIDs = append(interfaceIDs, c.interfaceIDs...)
+
+	disabledMetrics := []string{}
+	for metricName := range c.disabledMetrics {
+		disabledMetrics = append(disabledMetrics, metricName)
+	}
+	sort.Strings(disabledMetrics)
+
+	metricsAuthPassword := ""
+	if c.metricsAuthPassword != "" {
+		metricsAuthPassword = redacted
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"ntopng_url":                     c.ntopngURL.Redacted(),
+		"ntopng_api_base_path":           c.apiBasePath,
+		"ntopng_credentials":             redacted,
+		"ntopng_auth_mode":               c.authMode,
+		"user_agent":                     c.userAgent,
+		"http_proxy":                     httpProxy,
+		"ntopng_client_cert_file":        c.clientCertFile,
+		"ntopng_client_key_file":         c.clientKeyFile,
+		"max_requests_per_second":        c.maxRequestsPerSecond,
+		"max_idle_conns":                 c.maxIdleConns,
+		"max_idle_conns_per_host":        c.maxIdleConnsPerHost,
+		"idle_conn_timeout_seconds":      c.idleConnTimeout.Seconds(),
+		"prometheus_listen_address":      c.promListenAddress,
+		"prometheus_port":                c.promPort,
+		"prometheus_endpoint":            c.promEndpoint,
+		"metrics_max_in_flight":          c.metricsMaxInFlight,
+		"max_response_bytes":             c.maxResponseBytes,
+		"stats_base_path":                c.statsBasePath,
+		"msg_per_flow_messages_field":    c.msgPerFlowMessagesField,
+		"msg_per_flow_flows_field":       c.msgPerFlowFlowsField,
+		"timeseries":                     timeseries,
+		"interface_ids":                  interfaceIDs,
+		"max_interfaces":                 c.maxInterfaces,
+		"scrape_batch_size":              c.scrapeBatchSize,
+		"scrape_batch_gap_seconds":       c.scrapeBatchGap.Seconds(),
+		"min_interface_success_fraction": c.minSuccessFraction,
+		"enable_host_metrics":            c.enableHostMetrics,
+		"enable_alert_metrics":           c.enableAlertMetrics,
+		"max_hosts":                      c.maxHosts,
+		"disabled_metrics":               disabledMetrics,
+		"static_labels":                  c.staticLabels,
+		"metric_mappings":                c.metricMappings,
+		"enable_pprof":                   c.enablePprof,
+		"enable_ntopng_debug":            c.enableNtopngDebug,
+		"enable_stats_json":              c.enableStatsJSON,
+		"enable_selftest_endpoint":       c.enableSelftest,
+		"enable_exemplars":               c.enableExemplars,
+		"export_raw_values":              c.exportRawValues,
+		"strict_schema":                  c.strictSchema,
+		"enable_native_histograms":       c.enableNativeHistograms,
+		"disable_go_collector":           c.disableGoCollector,
+		"disable_process_collector":      c.disableProcessCollector,
+		"log_sample_interval_seconds":    c.logSampleInterval.Seconds(),
+		"metrics_auth_username":          c.metricsAuthUsername,
+		"metrics_auth_password":          metricsAuthPassword,
+		"metrics_tls_cert_file":          c.metricsTLSCertFile,
+		"metrics_tls_key_file":           c.metricsTLSKeyFile,
+		"pushgateway_url":                pushgatewayURL,
+		"pushgateway_job":                c.pushgatewayJob,
+		"disable_metrics_server":         c.disableMetricsServer,
+		"breaker_failure_threshold":      c.breakerFailureThreshold,
+		"breaker_cooldown_seconds":       c.breakerCooldown.Seconds(),
+		"retry_deadline_seconds":         c.retryDeadline.Seconds(),
+		"attempt_timeout_seconds":        c.attemptTimeout.Seconds(),
+		"shutdown_timeout_seconds":       c.shutdownTimeout.Seconds(),
+		"drain_grace_seconds":            c.drainGrace.Seconds(),
+		"startup_enum_timeout_seconds":   c.startupEnumTimeout.Seconds(),
+		"startup_enum_failure_mode":      c.startupEnumFailureMode,
+		"enumeration_interval_seconds":   c.enumerationInterval.Seconds(),
+		"zero_interfaces_behavior":       c.zeroInterfacesBehavior,
+		"collection_mode":                c.collectionMode,
+		"run_once":                       c.runOnce,
+		"run_once_timeout_seconds":       c.runOnceTimeout.Seconds(),
+	})
+}
+
+func requireBasicAuth(username string, password string, next http.Handler) http.Handler {
+	// compare sha256 digests so the comparison is constant time regardless of
+	// the length of what the client sent
+	expectedUser := sha256.Sum256([]byte(username))
+	expectedPass := sha256.Sum256([]byte(password))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if ok {
+			gotUser := sha256.Sum256([]byte(user))
+			gotPass := sha256.Sum256([]byte(pass))
+			userMatch := subtle.ConstantTimeCompare(gotUser[:], expectedUser[:]) == 1
+			passMatch := subtle.ConstantTimeCompare(gotPass[:], expectedPass[:]) == 1
+			if userMatch && passMatch {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="metrics", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// limitInFlight rejects requests with 429 once max requests are already being
+// served, so a misbehaving scraper can't pile up concurrent scrapes (each of
+// which may query ntopng in ondemand mode).
+func limitInFlight(max int, next http.Handler) http.Handler {
+	inFlight := make(chan struct{}, max)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inFlight <- struct{}{}:
+			defer func() { <-inFlight }()
+			next.ServeHTTP(w, r)
+		default:
+			http.Error(w, "Too many concurrent requests", http.StatusTooManyRequests)
+		}
+	})
+}
+
+// ntopngDebugHandler proxies the raw data.lua response for ?ifid=N back to the
+// caller so operators can see exactly what ntopng is returning.
+func ntopngDebugHandler(c config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ifid, err := strconv.Atoi(r.URL.Query().Get("ifid"))
+		if err != nil {
+			http.Error(w, "ifid query parameter must be an integer", http.StatusBadRequest)
+			return
+		}
+
+		// a single attempt; we don't want to hold the request open in the backoff loop
+		body, err := queryNtopMetricsWithRetries(c, ifid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	})
+}
+
+// newMetricsServer builds the HTTP server that serves /metrics and the
+// optional debug handlers. promExport() runs it; main() shuts it down.
+func newMetricsServer(c config, registry *prometheus.Registry) *http.Server {
+	// use our own mux rather than http.DefaultServeMux; importing net/http/pprof
+	// registers its handlers on the default mux and we only want them when asked
+	mux := http.NewServeMux()
+	// exemplars are only part of the OpenMetrics exposition format
+	var metricsHandler http.Handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		Registry:          prometheus.WrapRegistererWith(c.staticLabels, registry),
+		EnableOpenMetrics: c.enableExemplars,
+	})
+	if c.metricsAuthUsername != "" {
+		metricsHandler = requireBasicAuth(c.metricsAuthUsername, c.metricsAuthPassword, metricsHandler)
+	}
+	mux.Handle(c.promEndpoint, metricsHandler)
+
+	if c.enableNtopngDebug {
+		log.Println("Registering ntopng debug handler under /debug/ntopng")
+		var debugHandler http.Handler = ntopngDebugHandler(c)
+		if c.metricsAuthUsername != "" {
+			debugHandler = requireBasicAuth(c.metricsAuthUsername, c.metricsAuthPassword, debugHandler)
+		}
+		mux.Handle("/debug/ntopng", debugHandler)
+	}
+
+	if c.enableStatsJSON {
+		log.Println("Registering stats handler under", statsJSONPath)
+		var statsHandler http.Handler = statsJSONHandler()
+		if c.metricsAuthUsername != "" {
+			statsHandler = requireBasicAuth(c.metricsAuthUsername, c.metricsAuthPassword, statsHandler)
+		}
+		mux.Handle(statsJSONPath, statsHandler)
+	}
+
+	if c.enableSelftest {
+		log.Println("Registering self-test handler under", selftestPath)
+		var selftest http.Handler = selftestHandler(c)
+		if c.metricsAuthUsername != "" {
+			selftest = requireBasicAuth(c.metricsAuthUsername, c.metricsAuthPassword, selftest)
+		}
+		mux.Handle(selftestPath, selftest)
+	}
+
+	if c.enablePprof {
+		log.Println("Registering pprof handlers under /debug/pprof/")
+		pprofHandlers := map[string]http.HandlerFunc{
+			"/debug/pprof/":        pprof.Index,
+			"/debug/pprof/cmdline": pprof.Cmdline,
+			"/debug/pprof/profile": pprof.Profile,
+			"/debug/pprof/symbol":  pprof.Symbol,
+			"/debug/pprof/trace":   pprof.Trace,
+		}
+		for path, handlerFunc := range pprofHandlers {
+			// profiles expose heap contents and our command line
+			var pprofHandler http.Handler = handlerFunc
+			if c.metricsAuthUsername != "" {
+				pprofHandler = requireBasicAuth(c.metricsAuthUsername, c.metricsAuthPassword, pprofHandler)
+			}
+			mux.Handle(path, pprofHandler)
+		}
+	}
+
+	var handler http.Handler = mux
+	if c.metricsMaxInFlight > 0 {
+		handler = limitInFlight(c.metricsMaxInFlight, handler)
+	}
+
+	// the health check sits in front of METRICS_MAX_IN_FLIGHT and basic auth so
+	// a busy exporter isn't reported as dead and probes don't need credentials
+	root := http.NewServeMux()
+	root.Handle("/", handler)
+	root.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	root.HandleFunc(readyzPath, func(w http.ResponseWriter, r *http.Request) {
+		if exporterDraining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "draining\n")
+			return
+		}
+		if !exporterReady.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "not ready\n")
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+
+	// an empty address listens on all interfaces
+	return &http.Server{
+		Addr:    net.JoinHostPort(c.promListenAddress, c.promPort),
+		Handler: root,
+	}
+}
+
+// healthzPath answers 200 whenever the metrics server is up
+const healthzPath = "/healthz"
+
+// readyzPath answers 503 until exporterReady is set, then 200 until
+// exporterDraining is set
+const readyzPath = "/readyz"
+
+// exporterReady is set once we have something to export: after the first
+// successful scrape cycle in poll mode, or once the collector is registered
+// with at least one interface in the other modes. It is never unset again.
+var exporterReady atomic.Bool
+
+// exporterDraining is set on SIGUSR1, for DRAIN_GRACE_SECONDS before we shut
+// down
+var exporterDraining atomic.Bool
+
+// runHealthcheck makes a single request to the local /healthz endpoint of an
+// exporter running with the same config and returns the process exit code.
+// It exists so container images don't need curl for exec health checks.
+func runHealthcheck(c config) int {
+	host := c.promListenAddress
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+
+	scheme := "http"
+	client := &http.Client{Timeout: 5 * time.Second}
+	if c.metricsTLSCertFile != "" {
+		scheme = "https"
+		// the certificate is issued for the name clients use, not localhost
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		client.Transport = transport
+	}
+
+	healthURL := scheme + "://" + net.JoinHostPort(host, c.promPort) + healthzPath
+	resp, err := client.Get(healthURL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "healthcheck failed:", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "healthcheck failed:", healthURL, "returned", resp.Status)
+		return 1
+	}
+
+	return 0
+}
+
+func promExport(server *http.Server, c config) {
+	// Export prom metrics in a goroutine
+	// Running this in parallel since http.ListenAndServe() blocks forever
+	var err error
+	if c.metricsTLSCertFile != "" {
+		log.Println("Serving metrics over HTTPS on", server.Addr)
+		err = server.ListenAndServeTLS(c.metricsTLSCertFile, c.metricsTLSKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+
+	// ErrServerClosed just means main() is shutting us down
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+func parseConf() config {
+	// function to parse configuration from env vars. sets default values if it cannot
+	// find an env value.
+
+	collectionMode, exists := os.LookupEnv("COLLECTION_MODE")
+	if exists {
+		log.Println("COLLECTION_MODE:", collectionMode)
+		if collectionMode != collectionModePoll && collectionMode != collectionModeOnDemand && collectionMode != collectionModePassthrough {
+			log.Fatalf("COLLECTION_MODE must be %q, %q or %q, got %q", collectionModePoll, collectionModeOnDemand, collectionModePassthrough, collectionMode)
+		}
+	} else {
+		log.Println("COLLECTION_MODE not found. Setting to default value of poll")
+		collectionMode = collectionModePoll
+	}
+
+	ntopngUrl, exists := os.LookupEnv("NTOPNG_API_URL")
+	if exists {
+		log.Println("NTOPNG_API_URL:", ntopngUrl)
+	} else {
+		log.Println("NTOPNG_API_URL not found. Setting to default value of http://localhost")
+		ntopngUrl = "http://localhost"
+	}
+
+	ntopngPort, exists := os.LookupEnv("NTOPNG_API_PORT")
+	if exists {
+		log.Println("NTOPNG_API_PORT:", ntopngPort)
+	} else {
+		log.Println("NTOPNG_API_PORT not found. Using the port in NTOPNG_API_URL, or the default value of", defaultNtopngPort, "if it is plain http with no port or path")
+	}
+
+	apiBasePath, exists := os.LookupEnv("NTOPNG_API_BASE_PATH")
+	if exists {
+		log.Println("NTOPNG_API_BASE_PATH:", apiBasePath)
+	} else {
+		log.Println("NTOPNG_API_BASE_PATH not found. Setting to default value of /lua/rest/v2")
+		apiBasePath = "/lua/rest/v2"
+	}
+	// request paths are appended as "/get/...", so normalize to a leading slash
+	// and no trailing one
+	apiBasePath = "/" + strings.Trim(apiBasePath, "/")
+	if apiBasePath == "/" {
+		apiBasePath = ""
+	}
+
+	ntopngUsername, exists := os.LookupEnv("NTOPNG_USERNAME")
+	if exists {
+		log.Println("NTOPNG_USERNAME:", ntopngUsername)
+	} else {
+		log.Println("NTOPNG_USERNAME not found. Setting to default value of admin")
+		ntopngUsername = "admin"
+	}
+
+	ntopngPassword, exists := os.LookupEnv("NTOPNG_PASSWORD")
+	if exists {
+		log.Println("NTOPNG_PASSWORD set.")
+	} else {
+		log.Println("NTOPNG_PASSWORD not found. Setting to default value of admin")
+		ntopngPassword = "admin"
+	}
+
+	authMode, exists := os.LookupEnv("NTOPNG_AUTH_MODE")
+	if exists {
+		log.Println("NTOPNG_AUTH_MODE:", authMode)
+		if authMode != authModeBasic && authMode != authModeCookie {
+			log.Fatalf("NTOPNG_AUTH_MODE must be %q or %q, got %q", authModeBasic, authModeCookie, authMode)
+		}
+	} else {
+		log.Println("NTOPNG_AUTH_MODE not found. Setting to default value of basic")
+		authMode = authModeBasic
+	}
+
+	userAgent, exists := os.LookupEnv("NTOPNG_USER_AGENT")
+	if exists {
+		log.Println("NTOPNG_USER_AGENT:", userAgent)
+	} else {
+		userAgent = "ntopng-prom-exporter/" + version
+		log.Println("NTOPNG_USER_AGENT not found. Setting to default value of", userAgent)
+	}
+
+	var httpProxy *url.URL
+	httpProxyStr, exists := os.LookupEnv("NTOPNG_HTTP_PROXY")
+	if exists {
+		log.Println("NTOPNG_HTTP_PROXY:", httpProxyStr)
+		parsed, err := url.Parse(httpProxyStr)
+		if err != nil || parsed.Host == "" {
+			log.Fatalf("NTOPNG_HTTP_PROXY must be a URL such as http://proxy:3128, got %q", httpProxyStr)
+		}
+		httpProxy = parsed
+	} else {
+		log.Println("NTOPNG_HTTP_PROXY not found. Using HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment")
+	}
+
+	clientCertFile, exists := os.LookupEnv("NTOPNG_CLIENT_CERT_FILE")
+	if exists {
+		log.Println("NTOPNG_CLIENT_CERT_FILE:", clientCertFile)
+	} else {
+		log.Println("NTOPNG_CLIENT_CERT_FILE not found. No client certificate will be presented to ntopng")
+	}
+
+	clientKeyFile, exists := os.LookupEnv("NTOPNG_CLIENT_KEY_FILE")
+	if exists {
+		log.Println("NTOPNG_CLIENT_KEY_FILE:", clientKeyFile)
+	} else {
+		log.Println("NTOPNG_CLIENT_KEY_FILE not found.")
+	}
+
+	if (clientCertFile == "") != (clientKeyFile == "") {
+		log.Fatal("NTOPNG_CLIENT_CERT_FILE and NTOPNG_CLIENT_KEY_FILE must be set together")
+	}
+
+	var maxIdleConns int
+	maxIdleConnsStr, exists := os.LookupEnv("NTOPNG_MAX_IDLE_CONNS")
+	if exists {
+		log.Println("NTOPNG_MAX_IDLE_CONNS:", maxIdleConnsStr)
+		parsed, err := strconv.Atoi(maxIdleConnsStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("NTOPNG_MAX_IDLE_CONNS must be a non-negative integer, got %q", maxIdleConnsStr)
+		}
+		maxIdleConns = parsed
+	} else {
+		log.Println("NTOPNG_MAX_IDLE_CONNS not found. Setting to default value of 100")
+		maxIdleConns = 100
+	}
+
+	var maxIdleConnsPerHost int
+	maxIdleConnsPerHostStr, exists := os.LookupEnv("NTOPNG_MAX_IDLE_CONNS_PER_HOST")
+	if exists {
+		log.Println("NTOPNG_MAX_IDLE_CONNS_PER_HOST:", maxIdleConnsPerHostStr)
+		parsed, err := strconv.Atoi(maxIdleConnsPerHostStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("NTOPNG_MAX_IDLE_CONNS_PER_HOST must be a non-negative integer, got %q", maxIdleConnsPerHostStr)
+		}
+		maxIdleConnsPerHost = parsed
+	} else {
+		log.Println("NTOPNG_MAX_IDLE_CONNS_PER_HOST not found. Setting to default value of 10")
+		maxIdleConnsPerHost = 10
+	}
+
+	var idleConnTimeout time.Duration
+	idleConnTimeoutStr, exists := os.LookupEnv("NTOPNG_IDLE_CONN_TIMEOUT_SECONDS")
+	if exists {
+		log.Println("NTOPNG_IDLE_CONN_TIMEOUT_SECONDS:", idleConnTimeoutStr)
+		parsed, err := strconv.Atoi(idleConnTimeoutStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("NTOPNG_IDLE_CONN_TIMEOUT_SECONDS must be a non-negative integer, got %q", idleConnTimeoutStr)
+		}
+		idleConnTimeout = time.Duration(parsed) * time.Second
+	} else {
+		log.Println("NTOPNG_IDLE_CONN_TIMEOUT_SECONDS not found. Setting to default value of 90")
+		idleConnTimeout = 90 * time.Second
+	}
+
+	var maxRequestsPerSecond float64
+	maxRequestsPerSecondStr, exists := os.LookupEnv("NTOPNG_MAX_RPS")
+	if exists {
+		log.Println("NTOPNG_MAX_RPS:", maxRequestsPerSecondStr)
+		parsed, err := strconv.ParseFloat(maxRequestsPerSecondStr, 64)
+		if err != nil || parsed < 0 {
+			log.Fatalf("NTOPNG_MAX_RPS must be a non-negative number, got %q", maxRequestsPerSecondStr)
+		}
+		maxRequestsPerSecond = parsed
+	} else {
+		log.Println("NTOPNG_MAX_RPS not found. Outbound requests to ntopng will not be rate limited")
+		maxRequestsPerSecond = 0
+	}
+
+	var metricsMaxInFlight int
+	metricsMaxInFlightStr, exists := os.LookupEnv("METRICS_MAX_IN_FLIGHT")
+	if exists {
+		log.Println("METRICS_MAX_IN_FLIGHT:", metricsMaxInFlightStr)
+		parsed, err := strconv.Atoi(metricsMaxInFlightStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("METRICS_MAX_IN_FLIGHT must be a non-negative integer, got %q", metricsMaxInFlightStr)
+		}
+		metricsMaxInFlight = parsed
+	} else {
+		log.Println("METRICS_MAX_IN_FLIGHT not found. Concurrent requests to the metrics server will not be limited")
+		metricsMaxInFlight = 0
+	}
+
+	promListenAddress, exists := os.LookupEnv("PROMETHEUS_LISTEN_ADDRESS")
+	if exists {
+		log.Println("PROMETHEUS_LISTEN_ADDRESS:", promListenAddress)
+	} else {
+		log.Println("PROMETHEUS_LISTEN_ADDRESS not found. Listening on all interfaces")
+		promListenAddress = ""
+	}
+
+	promPort, exists := os.LookupEnv("PROMETHEUS_PORT")
+	if exists {
+		log.Println("PROMETHEUS_PORT:", promPort)
+	} else {
+		log.Println("PROMETHEUS_PORT not found. Setting to default value of 8888")
+		promPort = "8888"
+	}
+
+	promEndpoint, exists := os.LookupEnv("PROMETHEUS_ENDPOINT")
+	if exists {
+		log.Println("PROMETHEUS_ENDPOINT:", promEndpoint)
+	} else {
+		log.Println("PROMETHEUS_ENDPOINT not found. Setting to default value of /metrics")
+		promEndpoint = "/metrics"
+	}
+
+	metricsAuthUsername, exists := os.LookupEnv("METRICS_AUTH_USERNAME")
+	if exists {
+		log.Println("METRICS_AUTH_USERNAME:", metricsAuthUsername)
+	} else {
+		log.Println("METRICS_AUTH_USERNAME not found. Metrics endpoint will not require authentication")
+	}
+
+	metricsAuthPassword, exists := os.LookupEnv("METRICS_AUTH_PASSWORD")
+	if exists {
+		log.Println("METRICS_AUTH_PASSWORD set.")
+	} else {
+		log.Println("METRICS_AUTH_PASSWORD not found.")
+	}
+
+	if (metricsAuthUsername == "") != (metricsAuthPassword == "") {
+		log.Fatal("METRICS_AUTH_USERNAME and METRICS_AUTH_PASSWORD must be set together")
+	}
+
+	metricsTLSCertFile, exists := os.LookupEnv("METRICS_TLS_CERT_FILE")
+	if exists {
+		log.Println("METRICS_TLS_CERT_FILE:", metricsTLSCertFile)
+	} else {
+		log.Println("METRICS_TLS_CERT_FILE not found. Metrics endpoint will be served over plain HTTP")
+	}
+
+	metricsTLSKeyFile, exists := os.LookupEnv("METRICS_TLS_KEY_FILE")
+	if exists {
+		log.Println("METRICS_TLS_KEY_FILE:", metricsTLSKeyFile)
+	} else {
+		log.Println("METRICS_TLS_KEY_FILE not found.")
+	}
+
+	if (metricsTLSCertFile == "") != (metricsTLSKeyFile == "") {
+		log.Fatal("METRICS_TLS_CERT_FILE and METRICS_TLS_KEY_FILE must be set together")
+	}
+
+	var pushgatewayURL *url.URL
+	pushgatewayURLStr, exists := os.LookupEnv("PUSHGATEWAY_URL")
+	if exists {
+		parsed, err := url.Parse(pushgatewayURLStr)
+		if err != nil || parsed.Host == "" {
+			log.Fatalf("PUSHGATEWAY_URL must be a URL such as http://pushgateway:9091, got %q", pushgatewayURLStr)
+		}
+		log.Println("PUSHGATEWAY_URL:", parsed.Redacted())
+		pushgatewayURL = parsed
+	} else {
+		log.Println("PUSHGATEWAY_URL not found. Metrics will not be pushed")
+	}
+
+	pushgatewayJob, exists := os.LookupEnv("PUSHGATEWAY_JOB")
+	if exists {
+		log.Println("PUSHGATEWAY_JOB:", pushgatewayJob)
+		if pushgatewayJob == "" {
+			log.Fatal("PUSHGATEWAY_JOB must not be empty")
+		}
+	} else {
+		log.Println("PUSHGATEWAY_JOB not found. Setting to default value of ntopng-prom-exporter")
+		pushgatewayJob = "ntopng-prom-exporter"
+	}
+
+	var disableMetricsServer bool
+	disableMetricsServerStr, exists := os.LookupEnv("DISABLE_METRICS_SERVER")
+	if exists {
+		log.Println("DISABLE_METRICS_SERVER:", disableMetricsServerStr)
+		parsed, err := strconv.ParseBool(disableMetricsServerStr)
+		if err != nil {
+			log.Fatalf("DISABLE_METRICS_SERVER must be a boolean, got %q", disableMetricsServerStr)
+		}
+		disableMetricsServer = parsed
+	} else {
+		log.Println("DISABLE_METRICS_SERVER not found. Setting to default value of false")
+		disableMetricsServer = false
+	}
+
+	if disableMetricsServer && pushgatewayURL == nil {
+		log.Fatal("DISABLE_METRICS_SERVER requires PUSHGATEWAY_URL; otherwise nothing would export the metrics")
+	}
+
+	statsBasePath, exists := os.LookupEnv("NTOPNG_STATS_BASE_PATH")
+	if exists {
+		log.Println("NTOPNG_STATS_BASE_PATH:", statsBasePath)
+	} else {
+		log.Println("NTOPNG_STATS_BASE_PATH not found. Setting to default value of rsp.zmqRecvStats")
+		statsBasePath = "rsp.zmqRecvStats"
+	}
+
+	msgPerFlowMessagesField, exists := os.LookupEnv("MSG_PER_FLOW_MESSAGES_FIELD")
+	if exists {
+		log.Println("MSG_PER_FLOW_MESSAGES_FIELD:", msgPerFlowMessagesField)
+		if msgPerFlowMessagesField == "" {
+			log.Fatal("MSG_PER_FLOW_MESSAGES_FIELD must not be empty")
+		}
+	} else {
+		log.Println("MSG_PER_FLOW_MESSAGES_FIELD not found. Setting to default value of zmq_msg_rcvd")
+		msgPerFlowMessagesField = "zmq_msg_rcvd"
+	}
+
+	msgPerFlowFlowsField, exists := os.LookupEnv("MSG_PER_FLOW_FLOWS_FIELD")
+	if exists {
+		log.Println("MSG_PER_FLOW_FLOWS_FIELD:", msgPerFlowFlowsField)
+		if msgPerFlowFlowsField == "" {
+			log.Fatal("MSG_PER_FLOW_FLOWS_FIELD must not be empty")
+		}
+	} else {
+		log.Println("MSG_PER_FLOW_FLOWS_FIELD not found. Setting to default value of flows")
+		msgPerFlowFlowsField = "flows"
+	}
+
+	var timeseries []string
+	timeseriesStr, exists := os.LookupEnv("NTOPNG_TIMESERIES")
+	if exists {
+		log.Println("NTOPNG_TIMESERIES:", timeseriesStr)
+		for _, schema := range strings.Split(timeseriesStr, ",") {
+			schema = strings.TrimSpace(schema)
+			if schema != "" {
+				timeseries = append(timeseries, schema)
+			}
+		}
+	} else {
+		log.Println("NTOPNG_TIMESERIES not found. Timeseries will not be scraped")
+	}
+
+	var interfaceIDs []int
+	interfaceIDsStr, exists := os.LookupEnv("NTOPNG_INTERFACE_IDS")
+	if exists {
+		log.Println("NTOPNG_INTERFACE_IDS:", interfaceIDsStr)
+		seen := make(map[int]bool)
+		for _, ifidStr := range strings.Split(interfaceIDsStr, ",") {
+			ifidStr = strings.TrimSpace(ifidStr)
+			if ifidStr == "" {
+				continue
+			}
+			ifid, err := strconv.Atoi(ifidStr)
+			if err != nil || ifid < 0 {
+				log.Fatalf("NTOPNG_INTERFACE_IDS must be a comma-separated list of non-negative integers, got %q", ifidStr)
+			}
+			if !seen[ifid] {
+				seen[ifid] = true
+				interfaceIDs = append(interfaceIDs, ifid)
+			}
+		}
+		if len(interfaceIDs) == 0 {
+			log.Fatalf("NTOPNG_INTERFACE_IDS must list at least one interface id")
+		}
+	} else {
+		log.Println("NTOPNG_INTERFACE_IDS not found. Interfaces will be enumerated from ntopng")
+	}
+
+	var maxInterfaces int
+	maxInterfacesStr, exists := os.LookupEnv("MAX_INTERFACES")
+	if exists {
+		log.Println("MAX_INTERFACES:", maxInterfacesStr)
+		parsed, err := strconv.Atoi(maxInterfacesStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("MAX_INTERFACES must be a non-negative integer, got %q", maxInterfacesStr)
+		}
+		maxInterfaces = parsed
+	} else {
+		log.Println("MAX_INTERFACES not found. Setting to default value of 256")
+		maxInterfaces = 256
+	}
+
+	var scrapeBatchSize int
+	scrapeBatchSizeStr, exists := os.LookupEnv("SCRAPE_BATCH_SIZE")
+	if exists {
+		log.Println("SCRAPE_BATCH_SIZE:", scrapeBatchSizeStr)
+		parsed, err := strconv.Atoi(scrapeBatchSizeStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("SCRAPE_BATCH_SIZE must be a non-negative integer, got %q", scrapeBatchSizeStr)
+		}
+		scrapeBatchSize = parsed
+	} else {
+		log.Println("SCRAPE_BATCH_SIZE not found. Interfaces will be scraped back to back")
+		scrapeBatchSize = 0
+	}
+
+	var scrapeBatchGap time.Duration
+	scrapeBatchGapStr, exists := os.LookupEnv("SCRAPE_BATCH_GAP_SECONDS")
+	if exists {
+		log.Println("SCRAPE_BATCH_GAP_SECONDS:", scrapeBatchGapStr)
+		parsed, err := strconv.ParseFloat(scrapeBatchGapStr, 64)
+		if err != nil || parsed < 0 {
+			log.Fatalf("SCRAPE_BATCH_GAP_SECONDS must be a non-negative number, got %q", scrapeBatchGapStr)
+		}
+		scrapeBatchGap = time.Duration(parsed * float64(time.Second))
+	} else {
+		log.Println("SCRAPE_BATCH_GAP_SECONDS not found. Setting to default value of 0.2")
+		scrapeBatchGap = 200 * time.Millisecond
+	}
 
-var (
-	nettel_zmq_msg_drops = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "nettel_zmq_msg_drops",
-		Help: "Count of gcpnettel zmq message drops.",
-	}, []string{"hostname", "ifid"}) // labels for the metrics
-)
+	var minInterfaceSuccessFraction float64
+	minInterfaceSuccessFractionStr, exists := os.LookupEnv("MIN_INTERFACE_SUCCESS_FRACTION")
+	if exists {
+		log.Println("MIN_INTERFACE_SUCCESS_FRACTION:", minInterfaceSuccessFractionStr)
+		parsed, err := strconv.ParseFloat(minInterfaceSuccessFractionStr, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			log.Fatalf("MIN_INTERFACE_SUCCESS_FRACTION must be a number between 0 and 1, got %q", minInterfaceSuccessFractionStr)
+		}
+		minInterfaceSuccessFraction = parsed
+	} else {
+		log.Println("MIN_INTERFACE_SUCCESS_FRACTION not found. Setting to default value of 0.5")
+		minInterfaceSuccessFraction = 0.5
+	}
 
-var (
-	nettel_zmq_avg_msg_perflow = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "nettel_zmq_avg_msg_perflows",
-		Help: "Count of average zmq messages per flow. This should probs be a gague however........",
-	}, []string{"hostname", "ifid"}) // labels for the metrics
-)
+	var enableHostMetrics bool
+	enableHostMetricsStr, exists := os.LookupEnv("ENABLE_HOST_METRICS")
+	if exists {
+		log.Println("ENABLE_HOST_METRICS:", enableHostMetricsStr)
+		parsed, err := strconv.ParseBool(enableHostMetricsStr)
+		if err != nil {
+			log.Fatalf("ENABLE_HOST_METRICS must be a boolean, got %q", enableHostMetricsStr)
+		}
+		enableHostMetrics = parsed
+	} else {
+		log.Println("ENABLE_HOST_METRICS not found. Setting to default value of false")
+		enableHostMetrics = false
+	}
 
-// struct to hold config values
-type config struct {
-	ntopngFullUrl            string
-	basicAuthenticationToken string
-	promPort                 string
-	promEndpoint             string
-}
+	var enableAlertMetrics bool
+	enableAlertMetricsStr, exists := os.LookupEnv("ENABLE_ALERT_METRICS")
+	if exists {
+		log.Println("ENABLE_ALERT_METRICS:", enableAlertMetricsStr)
+		parsed, err := strconv.ParseBool(enableAlertMetricsStr)
+		if err != nil {
+			log.Fatalf("ENABLE_ALERT_METRICS must be a boolean, got %q", enableAlertMetricsStr)
+		}
+		enableAlertMetrics = parsed
+	} else {
+		log.Println("ENABLE_ALERT_METRICS not found. Setting to default value of false")
+		enableAlertMetrics = false
+	}
 
-func promExport(promPort string, promEndpoint string) {
-	// Export prom metrics in a goroutine
-	// Running this in parallel since http.ListenAndServe() blocks forever
-	http.Handle(promEndpoint, promhttp.Handler())
-	http.ListenAndServe(fmt.Sprintf(":%s", promPort), nil)
-}
+	var maxHosts int
+	maxHostsStr, exists := os.LookupEnv("MAX_HOSTS")
+	if exists {
+		log.Println("MAX_HOSTS:", maxHostsStr)
+		parsed, err := strconv.Atoi(maxHostsStr)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("MAX_HOSTS must be a positive integer, got %q", maxHostsStr)
+		}
+		maxHosts = parsed
+	} else {
+		log.Println("MAX_HOSTS not found. Setting to default value of 100")
+		maxHosts = 100
+	}
 
-func parseConf() config {
-	// function to parse configuration from env vars. sets default values if it cannot
-	// find an env value.
+	disabledMetrics := make(map[string]bool)
+	disabledMetricsStr, exists := os.LookupEnv("DISABLED_METRICS")
+	if exists {
+		log.Println("DISABLED_METRICS:", disabledMetricsStr)
+		for _, metricName := range strings.Split(disabledMetricsStr, ",") {
+			metricName = strings.TrimSpace(metricName)
+			if metricName == "" {
+				continue
+			}
+			if _, ok := zmqMetrics[metricName]; !ok {
+				log.Fatalf("DISABLED_METRICS contains unknown metric %q", metricName)
+			}
+			disabledMetrics[metricName] = true
+		}
+	} else {
+		log.Println("DISABLED_METRICS not found. All metrics are enabled")
+	}
 
-	ntopngUrl, exists := os.LookupEnv("NTOPNG_API_URL")
+	staticLabels := prometheus.Labels{}
+	staticLabelsStr, exists := os.LookupEnv("STATIC_LABELS")
 	if exists {
-		log.Println("NTOPNG_API_URL:", ntopngUrl)
+		log.Println("STATIC_LABELS:", staticLabelsStr)
+		parsed, err := parseStaticLabels(staticLabelsStr)
+		if err != nil {
+			log.Fatalf("Invalid STATIC_LABELS: %v", err)
+		}
+		staticLabels = parsed
 	} else {
-		log.Println("NTOPNG_API_URL not found. Setting to default value of http://localhost")
-		ntopngUrl = "http://localhost"
+		log.Println("STATIC_LABELS not found. No labels will be added to every metric")
 	}
 
-	ntopngPort, exists := os.LookupEnv("NTOPNG_API_PORT")
+	metricMappings := make(map[string]metricMapping)
+	metricMappingFile, exists := os.LookupEnv("METRIC_MAPPING_FILE")
 	if exists {
-		log.Println("NTOPNG_API_PORT:", ntopngPort)
+		log.Println("METRIC_MAPPING_FILE:", metricMappingFile)
+		parsed, err := readMetricMappings(metricMappingFile)
+		if err != nil {
+			log.Fatalf("Unable to read METRIC_MAPPING_FILE: %v", err)
+		}
+		metricMappings = parsed
 	} else {
-		log.Println("NTOPNG_API_PORT not found. Setting to default value of 3000")
-		ntopngPort = "3000"
+		log.Println("METRIC_MAPPING_FILE not found. Using default metric definitions")
 	}
 
-	ntopngUsername, exists := os.LookupEnv("NTOPNG_USERNAME")
+	var breakerFailureThreshold int
+	breakerFailureThresholdStr, exists := os.LookupEnv("NTOPNG_BREAKER_FAILURE_THRESHOLD")
 	if exists {
-		log.Println("NTOPNG_USERNAME:", ntopngUsername)
+		log.Println("NTOPNG_BREAKER_FAILURE_THRESHOLD:", breakerFailureThresholdStr)
+		parsed, err := strconv.Atoi(breakerFailureThresholdStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("NTOPNG_BREAKER_FAILURE_THRESHOLD must be a non-negative integer, got %q", breakerFailureThresholdStr)
+		}
+		breakerFailureThreshold = parsed
 	} else {
-		log.Println("NTOPNG_USERNAME not found. Setting to default value of admin")
-		ntopngUsername = "admin"
+		log.Println("NTOPNG_BREAKER_FAILURE_THRESHOLD not found. Setting to default value of 5")
+		breakerFailureThreshold = 5
 	}
 
-	ntopngPassword, exists := os.LookupEnv("NTOPNG_PASSWORD")
+	var breakerCooldown time.Duration
+	breakerCooldownStr, exists := os.LookupEnv("NTOPNG_BREAKER_COOLDOWN_SECONDS")
 	if exists {
-		log.Println("NTOPNG_PASSWORD set.")
+		log.Println("NTOPNG_BREAKER_COOLDOWN_SECONDS:", breakerCooldownStr)
+		parsed, err := strconv.Atoi(breakerCooldownStr)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("NTOPNG_BREAKER_COOLDOWN_SECONDS must be a positive integer, got %q", breakerCooldownStr)
+		}
+		breakerCooldown = time.Duration(parsed) * time.Second
 	} else {
-		log.Println("NTOPNG_PASSWORD not found. Setting to default value of admin")
-		ntopngPassword = "admin"
+		log.Println("NTOPNG_BREAKER_COOLDOWN_SECONDS not found. Setting to default value of 60")
+		breakerCooldown = 60 * time.Second
 	}
 
-	promPort, exists := os.LookupEnv("PROMETHEUS_PORT")
+	var retryDeadline time.Duration
+	retryDeadlineStr, exists := os.LookupEnv("NTOPNG_RETRY_DEADLINE_SECONDS")
 	if exists {
-		log.Println("PROMETHEUS_PORT:", promPort)
+		log.Println("NTOPNG_RETRY_DEADLINE_SECONDS:", retryDeadlineStr)
+		parsed, err := strconv.Atoi(retryDeadlineStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("NTOPNG_RETRY_DEADLINE_SECONDS must be a non-negative integer, got %q", retryDeadlineStr)
+		}
+		retryDeadline = time.Duration(parsed) * time.Second
 	} else {
-		log.Println("PROMETHEUS_PORT not found. Setting to default value of 8888")
-		promPort = "8888"
+		log.Println("NTOPNG_RETRY_DEADLINE_SECONDS not found. Retries are only bounded by count")
+		retryDeadline = 0
 	}
 
-	promEndpoint, exists := os.LookupEnv("PROMETHEUS_ENDPOINT")
+	var attemptTimeout time.Duration
+	attemptTimeoutStr, exists := os.LookupEnv("NTOPNG_ATTEMPT_TIMEOUT_SECONDS")
 	if exists {
-		log.Println("PROMETHEUS_ENDPOINT:", promEndpoint)
+		log.Println("NTOPNG_ATTEMPT_TIMEOUT_SECONDS:", attemptTimeoutStr)
+		parsed, err := strconv.Atoi(attemptTimeoutStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("NTOPNG_ATTEMPT_TIMEOUT_SECONDS must be a non-negative integer, got %q", attemptTimeoutStr)
+		}
+		attemptTimeout = time.Duration(parsed) * time.Second
 	} else {
-		log.Println("PROMETHEUS_ENDPOINT not found. Setting to default value of /metrics")
-		promEndpoint = "/metrics"
+		log.Println("NTOPNG_ATTEMPT_TIMEOUT_SECONDS not found. Individual requests to ntopng will not time out")
+		attemptTimeout = 0
+	}
+
+	var shutdownTimeout time.Duration
+	shutdownTimeoutStr, exists := os.LookupEnv("SHUTDOWN_TIMEOUT_SECONDS")
+	if exists {
+		log.Println("SHUTDOWN_TIMEOUT_SECONDS:", shutdownTimeoutStr)
+		parsed, err := strconv.Atoi(shutdownTimeoutStr)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("SHUTDOWN_TIMEOUT_SECONDS must be a positive integer, got %q", shutdownTimeoutStr)
+		}
+		shutdownTimeout = time.Duration(parsed) * time.Second
+	} else {
+		log.Println("SHUTDOWN_TIMEOUT_SECONDS not found. Setting to default value of 10")
+		shutdownTimeout = 10 * time.Second
+	}
+
+	var drainGrace time.Duration
+	drainGraceStr, exists := os.LookupEnv("DRAIN_GRACE_SECONDS")
+	if exists {
+		log.Println("DRAIN_GRACE_SECONDS:", drainGraceStr)
+		parsed, err := strconv.Atoi(drainGraceStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("DRAIN_GRACE_SECONDS must be a non-negative integer, got %q", drainGraceStr)
+		}
+		drainGrace = time.Duration(parsed) * time.Second
+	} else {
+		log.Println("DRAIN_GRACE_SECONDS not found. Setting to default value of 15")
+		drainGrace = 15 * time.Second
+	}
+
+	var startupEnumTimeout time.Duration
+	startupEnumTimeoutStr, exists := os.LookupEnv("STARTUP_ENUM_TIMEOUT_SECONDS")
+	if exists {
+		log.Println("STARTUP_ENUM_TIMEOUT_SECONDS:", startupEnumTimeoutStr)
+		parsed, err := strconv.Atoi(startupEnumTimeoutStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("STARTUP_ENUM_TIMEOUT_SECONDS must be a non-negative integer, got %q", startupEnumTimeoutStr)
+		}
+		startupEnumTimeout = time.Duration(parsed) * time.Second
+	} else {
+		log.Println("STARTUP_ENUM_TIMEOUT_SECONDS not found. Waiting for interface enumeration indefinitely")
+		startupEnumTimeout = 0
+	}
+
+	startupEnumFailureMode, exists := os.LookupEnv("STARTUP_ENUM_FAILURE_MODE")
+	if exists {
+		log.Println("STARTUP_ENUM_FAILURE_MODE:", startupEnumFailureMode)
+		if startupEnumFailureMode != startupEnumFailureExit && startupEnumFailureMode != startupEnumFailureBackground {
+			log.Fatalf("STARTUP_ENUM_FAILURE_MODE must be %q or %q, got %q", startupEnumFailureExit, startupEnumFailureBackground, startupEnumFailureMode)
+		}
+	} else {
+		log.Println("STARTUP_ENUM_FAILURE_MODE not found. Setting to default value of background")
+		startupEnumFailureMode = startupEnumFailureBackground
+	}
+
+	var enumerationInterval time.Duration
+	enumerationIntervalStr, exists := os.LookupEnv("ENUMERATION_INTERVAL_SECONDS")
+	if exists {
+		log.Println("ENUMERATION_INTERVAL_SECONDS:", enumerationIntervalStr)
+		parsed, err := strconv.Atoi(enumerationIntervalStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("ENUMERATION_INTERVAL_SECONDS must be a non-negative integer, got %q", enumerationIntervalStr)
+		}
+		enumerationInterval = time.Duration(parsed) * time.Second
+	} else {
+		log.Println("ENUMERATION_INTERVAL_SECONDS not found. Setting to default value of 300")
+		enumerationInterval = 300 * time.Second
+	}
+
+	zeroInterfacesBehavior, exists := os.LookupEnv("ZERO_INTERFACES_BEHAVIOR")
+	if exists {
+		log.Println("ZERO_INTERFACES_BEHAVIOR:", zeroInterfacesBehavior)
+		if zeroInterfacesBehavior != zeroInterfacesWait && zeroInterfacesBehavior != zeroInterfacesFail {
+			log.Fatalf("ZERO_INTERFACES_BEHAVIOR must be %q or %q, got %q", zeroInterfacesWait, zeroInterfacesFail, zeroInterfacesBehavior)
+		}
+	} else {
+		log.Println("ZERO_INTERFACES_BEHAVIOR not found. Setting to default value of wait")
+		zeroInterfacesBehavior = zeroInterfacesWait
+	}
+
+	var maxResponseBytes int64
+	maxResponseBytesStr, exists := os.LookupEnv("NTOPNG_MAX_RESPONSE_BYTES")
+	if exists {
+		log.Println("NTOPNG_MAX_RESPONSE_BYTES:", maxResponseBytesStr)
+		parsed, err := strconv.ParseInt(maxResponseBytesStr, 10, 64)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("NTOPNG_MAX_RESPONSE_BYTES must be a positive integer, got %q", maxResponseBytesStr)
+		}
+		maxResponseBytes = parsed
+	} else {
+		log.Println("NTOPNG_MAX_RESPONSE_BYTES not found. Setting to default value of 8388608 (8MB)")
+		maxResponseBytes = 8 * 1024 * 1024
+	}
+
+	var enablePprof bool
+	enablePprofStr, exists := os.LookupEnv("ENABLE_PPROF")
+	if exists {
+		log.Println("ENABLE_PPROF:", enablePprofStr)
+		parsed, err := strconv.ParseBool(enablePprofStr)
+		if err != nil {
+			log.Fatalf("ENABLE_PPROF must be a boolean, got %q", enablePprofStr)
+		}
+		enablePprof = parsed
+	} else {
+		log.Println("ENABLE_PPROF not found. Setting to default value of false")
+		enablePprof = false
+	}
+
+	var enableNtopngDebug bool
+	enableNtopngDebugStr, exists := os.LookupEnv("ENABLE_NTOPNG_DEBUG_ENDPOINT")
+	if exists {
+		log.Println("ENABLE_NTOPNG_DEBUG_ENDPOINT:", enableNtopngDebugStr)
+		parsed, err := strconv.ParseBool(enableNtopngDebugStr)
+		if err != nil {
+			log.Fatalf("ENABLE_NTOPNG_DEBUG_ENDPOINT must be a boolean, got %q", enableNtopngDebugStr)
+		}
+		enableNtopngDebug = parsed
+	} else {
+		log.Println("ENABLE_NTOPNG_DEBUG_ENDPOINT not found. Setting to default value of false")
+		enableNtopngDebug = false
+	}
+
+	var enableStatsJSON bool
+	enableStatsJSONStr, exists := os.LookupEnv("ENABLE_STATS_JSON")
+	if exists {
+		log.Println("ENABLE_STATS_JSON:", enableStatsJSONStr)
+		parsed, err := strconv.ParseBool(enableStatsJSONStr)
+		if err != nil {
+			log.Fatalf("ENABLE_STATS_JSON must be a boolean, got %q", enableStatsJSONStr)
+		}
+		enableStatsJSON = parsed
+	} else {
+		log.Println("ENABLE_STATS_JSON not found. Setting to default value of false")
+		enableStatsJSON = false
+	}
+
+	var enableSelftest bool
+	enableSelftestStr, exists := os.LookupEnv("ENABLE_SELFTEST_ENDPOINT")
+	if exists {
+		log.Println("ENABLE_SELFTEST_ENDPOINT:", enableSelftestStr)
+		parsed, err := strconv.ParseBool(enableSelftestStr)
+		if err != nil {
+			log.Fatalf("ENABLE_SELFTEST_ENDPOINT must be a boolean, got %q", enableSelftestStr)
+		}
+		enableSelftest = parsed
+	} else {
+		log.Println("ENABLE_SELFTEST_ENDPOINT not found. Setting to default value of false")
+		enableSelftest = false
+	}
+
+	var enableExemplars bool
+	enableExemplarsStr, exists := os.LookupEnv("ENABLE_EXEMPLARS")
+	if exists {
+		log.Println("ENABLE_EXEMPLARS:", enableExemplarsStr)
+		parsed, err := strconv.ParseBool(enableExemplarsStr)
+		if err != nil {
+			log.Fatalf("ENABLE_EXEMPLARS must be a boolean, got %q", enableExemplarsStr)
+		}
+		enableExemplars = parsed
+	} else {
+		log.Println("ENABLE_EXEMPLARS not found. Setting to default value of false")
+		enableExemplars = false
+	}
+
+	var exportRawValues bool
+	exportRawValuesStr, exists := os.LookupEnv("EXPORT_RAW_VALUES")
+	if exists {
+		log.Println("EXPORT_RAW_VALUES:", exportRawValuesStr)
+		parsed, err := strconv.ParseBool(exportRawValuesStr)
+		if err != nil {
+			log.Fatalf("EXPORT_RAW_VALUES must be a boolean, got %q", exportRawValuesStr)
+		}
+		exportRawValues = parsed
+	} else {
+		log.Println("EXPORT_RAW_VALUES not found. Setting to default value of false")
+		exportRawValues = false
+	}
+
+	var logSampleInterval time.Duration
+	logSampleIntervalStr, exists := os.LookupEnv("LOG_SAMPLE_INTERVAL_SECONDS")
+	if exists {
+		log.Println("LOG_SAMPLE_INTERVAL_SECONDS:", logSampleIntervalStr)
+		parsed, err := strconv.Atoi(logSampleIntervalStr)
+		if err != nil || parsed < 0 {
+			log.Fatalf("LOG_SAMPLE_INTERVAL_SECONDS must be a non-negative integer, got %q", logSampleIntervalStr)
+		}
+		logSampleInterval = time.Duration(parsed) * time.Second
+	} else {
+		log.Println("LOG_SAMPLE_INTERVAL_SECONDS not found. Repeated errors will not be sampled")
+		logSampleInterval = 0
+	}
+
+	var disableGoCollector bool
+	disableGoCollectorStr, exists := os.LookupEnv("DISABLE_GO_COLLECTOR")
+	if exists {
+		log.Println("DISABLE_GO_COLLECTOR:", disableGoCollectorStr)
+		parsed, err := strconv.ParseBool(disableGoCollectorStr)
+		if err != nil {
+			log.Fatalf("DISABLE_GO_COLLECTOR must be a boolean, got %q", disableGoCollectorStr)
+		}
+		disableGoCollector = parsed
+	} else {
+		log.Println("DISABLE_GO_COLLECTOR not found. Setting to default value of false")
+		disableGoCollector = false
+	}
+
+	var disableProcessCollector bool
+	disableProcessCollectorStr, exists := os.LookupEnv("DISABLE_PROCESS_COLLECTOR")
+	if exists {
+		log.Println("DISABLE_PROCESS_COLLECTOR:", disableProcessCollectorStr)
+		parsed, err := strconv.ParseBool(disableProcessCollectorStr)
+		if err != nil {
+			log.Fatalf("DISABLE_PROCESS_COLLECTOR must be a boolean, got %q", disableProcessCollectorStr)
+		}
+		disableProcessCollector = parsed
+	} else {
+		log.Println("DISABLE_PROCESS_COLLECTOR not found. Setting to default value of false")
+		disableProcessCollector = false
+	}
+
+	var runOnce bool
+	runOnceStr, exists := os.LookupEnv("RUN_ONCE")
+	if exists {
+		log.Println("RUN_ONCE:", runOnceStr)
+		parsed, err := strconv.ParseBool(runOnceStr)
+		if err != nil {
+			log.Fatalf("RUN_ONCE must be a boolean, got %q", runOnceStr)
+		}
+		runOnce = parsed
+	} else {
+		log.Println("RUN_ONCE not found. Setting to default value of false")
+		runOnce = false
+	}
+
+	var runOnceTimeout time.Duration
+	runOnceTimeoutStr, exists := os.LookupEnv("RUN_ONCE_TIMEOUT_SECONDS")
+	if exists {
+		log.Println("RUN_ONCE_TIMEOUT_SECONDS:", runOnceTimeoutStr)
+		parsed, err := strconv.Atoi(runOnceTimeoutStr)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("RUN_ONCE_TIMEOUT_SECONDS must be a positive integer, got %q", runOnceTimeoutStr)
+		}
+		runOnceTimeout = time.Duration(parsed) * time.Second
+	} else {
+		log.Println("RUN_ONCE_TIMEOUT_SECONDS not found. Setting to default value of 120")
+		runOnceTimeout = 120 * time.Second
+	}
+
+	var enableNativeHistograms bool
+	enableNativeHistogramsStr, exists := os.LookupEnv("ENABLE_NATIVE_HISTOGRAMS")
+	if exists {
+		log.Println("ENABLE_NATIVE_HISTOGRAMS:", enableNativeHistogramsStr)
+		parsed, err := strconv.ParseBool(enableNativeHistogramsStr)
+		if err != nil {
+			log.Fatalf("ENABLE_NATIVE_HISTOGRAMS must be a boolean, got %q", enableNativeHistogramsStr)
+		}
+		enableNativeHistograms = parsed
+	} else {
+		log.Println("ENABLE_NATIVE_HISTOGRAMS not found. Setting to default value of false")
+		enableNativeHistograms = false
+	}
+
+	var strictSchema bool
+	strictSchemaStr, exists := os.LookupEnv("STRICT_SCHEMA")
+	if exists {
+		log.Println("STRICT_SCHEMA:", strictSchemaStr)
+		parsed, err := strconv.ParseBool(strictSchemaStr)
+		if err != nil {
+			log.Fatalf("STRICT_SCHEMA must be a boolean, got %q", strictSchemaStr)
+		}
+		strictSchema = parsed
+	} else {
+		log.Println("STRICT_SCHEMA not found. Setting to default value of false")
+		strictSchema = false
 	}
 
-	ntopngFullUrl := ntopngUrl + string(':') + ntopngPort
+	// request paths are joined onto the URL, so http://ntop/ and http://ntop
+	// must mean the same thing
+	ntopngUrl = strings.TrimRight(ntopngUrl, "/")
+	ntopngURL, err := joinHostPortURL(ntopngUrl, ntopngPort)
+	if err != nil {
+		log.Fatalf("NTOPNG_API_URL must be a URL such as http://localhost or http://localhost:3000, or http://[::1] for an IPv6 address, and any port in it must match NTOPNG_API_PORT: %v", err)
+	}
 
 	usernamePass := ntopngUsername + string(':') + ntopngPassword
 	basicAuthenticationToken := base64.StdEncoding.EncodeToString([]byte(usernamePass))
 
 	configuration := config{
-		ntopngFullUrl:            ntopngFullUrl,
+		ntopngURL:                ntopngURL,
+		apiBasePath:              apiBasePath,
 		basicAuthenticationToken: basicAuthenticationToken,
+		ntopngUsername:           ntopngUsername,
+		ntopngPassword:           ntopngPassword,
+		authMode:                 authMode,
+		userAgent:                userAgent,
+		httpProxy:                httpProxy,
+		clientCertFile:           clientCertFile,
+		clientKeyFile:            clientKeyFile,
+		maxRequestsPerSecond:     maxRequestsPerSecond,
+		maxIdleConns:             maxIdleConns,
+		maxIdleConnsPerHost:      maxIdleConnsPerHost,
+		idleConnTimeout:          idleConnTimeout,
+		promListenAddress:        promListenAddress,
+		metricsMaxInFlight:       metricsMaxInFlight,
 		promPort:                 promPort,
 		promEndpoint:             promEndpoint,
+		maxResponseBytes:         maxResponseBytes,
+		statsBasePath:            statsBasePath,
+		msgPerFlowMessagesField:  msgPerFlowMessagesField,
+		msgPerFlowFlowsField:     msgPerFlowFlowsField,
+		timeseries:               timeseries,
+		interfaceIDs:             interfaceIDs,
+		maxInterfaces:            maxInterfaces,
+		scrapeBatchSize:          scrapeBatchSize,
+		scrapeBatchGap:           scrapeBatchGap,
+		minSuccessFraction:       minInterfaceSuccessFraction,
+		enableHostMetrics:        enableHostMetrics,
+		enableAlertMetrics:       enableAlertMetrics,
+		maxHosts:                 maxHosts,
+		disabledMetrics:          disabledMetrics,
+		staticLabels:             staticLabels,
+		metricMappings:           metricMappings,
+		enablePprof:              enablePprof,
+		enableNtopngDebug:        enableNtopngDebug,
+		enableStatsJSON:          enableStatsJSON,
+		enableSelftest:           enableSelftest,
+		enableExemplars:          enableExemplars,
+		exportRawValues:          exportRawValues,
+		strictSchema:             strictSchema,
+		enableNativeHistograms:   enableNativeHistograms,
+		disableGoCollector:       disableGoCollector,
+		disableProcessCollector:  disableProcessCollector,
+		logSampleInterval:        logSampleInterval,
+		metricsAuthUsername:      metricsAuthUsername,
+		metricsAuthPassword:      metricsAuthPassword,
+		metricsTLSCertFile:       metricsTLSCertFile,
+		metricsTLSKeyFile:        metricsTLSKeyFile,
+		pushgatewayURL:           pushgatewayURL,
+		pushgatewayJob:           pushgatewayJob,
+		disableMetricsServer:     disableMetricsServer,
+		breakerFailureThreshold:  breakerFailureThreshold,
+		breakerCooldown:          breakerCooldown,
+		retryDeadline:            retryDeadline,
+		attemptTimeout:           attemptTimeout,
+		shutdownTimeout:          shutdownTimeout,
+		drainGrace:               drainGrace,
+		startupEnumTimeout:       startupEnumTimeout,
+		startupEnumFailureMode:   startupEnumFailureMode,
+		enumerationInterval:      enumerationInterval,
+		zeroInterfacesBehavior:   zeroInterfacesBehavior,
+		collectionMode:           collectionMode,
+		runOnce:                  runOnce,
+		runOnceTimeout:           runOnceTimeout,
 	}
 
 	return configuration
 }
 
-func queryNtopMetricsWithRetries(ntopngFullUrl string, basicAuthenticationToken string, ifid int) (string, error) {
-	var url = fmt.Sprintf("%s/lua/rest/v2/get/interface/data.lua?ifid=%d", ntopngFullUrl, ifid)
+func checkResponseStatus(resp *http.Response, endpoint string) error {
+	ntopng_api_responses.WithLabelValues(strconv.Itoa(resp.StatusCode), endpoint).Inc()
 
-	req, _ := http.NewRequest("GET", url, nil)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &statusError{statusCode: resp.StatusCode, url: resp.Request.URL.String()}
+	}
+
+	return nil
+}
+
+func newNtopngHTTPClient(c config) *http.Client {
+	// DisableCompression stays off: the transport then asks ntopng for gzip and
+	// transparently decompresses it, as long as nobody sets Accept-Encoding on
+	// a request themselves
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	// we talk to a single ntopng host, so the per-host idle limit is the one
+	// that matters. The default of 2 churns connections once several requests
+	// are in flight.
+	transport.MaxIdleConns = c.maxIdleConns
+	transport.MaxIdleConnsPerHost = c.maxIdleConnsPerHost
+	transport.IdleConnTimeout = c.idleConnTimeout
+
+	// an explicit NTOPNG_HTTP_PROXY wins; otherwise honor HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY
+	if c.httpProxy != nil {
+		transport.Proxy = http.ProxyURL(c.httpProxy)
+	} else {
+		transport.Proxy = http.ProxyFromEnvironment
+	}
+
+	// for ntopng deployments that require client certificate authentication
+	if c.clientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.clientCertFile, c.clientKeyFile)
+		if err != nil {
+			log.Fatalf("Unable to load NTOPNG_CLIENT_CERT_FILE/NTOPNG_CLIENT_KEY_FILE: %v", err)
+		}
+		transport.TLSClientConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	client := &http.Client{Transport: transport}
 
-	req.Header.Set("Authorization", "Basic "+basicAuthenticationToken)
+	if c.authMode == authModeCookie {
+		// holds the ntopng session cookie for every request
+		jar, _ := cookiejar.New(nil)
+		client.Jar = jar
+		// ntopng redirects to its login page when the session has expired;
+		// sendNtopRequest needs to see that redirect to log in again
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
 
-	client := &http.Client{}
+	return client
+}
 
-	resp, err := client.Do(req)
+// requestIDHeader carries our per-request correlation ID to ntopng, and lets
+// readResponseBody find it again for its errors
+const requestIDHeader = "X-Request-ID"
 
+// newCorrelationID returns a short random id used to group the log lines of
+// one scrape cycle or one ntopng request
+func newCorrelationID() string {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
 	if err != nil {
-		fmt.Println(err)
+		return "00000000"
+	}
+	return hex.EncodeToString(b)
+}
 
-		return "nil", err
+// doNtopRequest sends req to ntopng through the rate limiter and circuit
+// breaker and returns an error for transport failures and non-2xx responses.
+// On success the caller owns resp.Body.
+func doNtopRequest(req *http.Request, endpoint string) (*http.Response, error) {
+	return doNtopRequestWithBreaker(req, endpoint, ntopngBreaker)
+}
+
+// doNtopRequestWithBreaker is doNtopRequest with the circuit breaker to consult
+// and feed. A nil breaker lets every request through, which is what diagnostic
+// requests such as /selftest and --discover want: their failures shouldn't
+// open the breaker the scraper relies on.
+func doNtopRequestWithBreaker(req *http.Request, endpoint string, breaker *circuitBreaker) (*http.Response, error) {
+	requestID := newCorrelationID()
+	req.Header.Set(requestIDHeader, requestID)
+
+	if ntopngAuth == nil {
+		resp, err := attemptNtopRequest(req, endpoint, breaker)
+		if err != nil {
+			return nil, fmt.Errorf("request %s: %w", requestID, err)
+		}
+		return resp, nil
+	}
+
+	// in cookie mode we need a session first. Logging in is a request of its
+	// own, so it takes its own turn with the limiter and breaker. If ntopng
+	// says the session has expired, log in again and resend once.
+	var session uint64
+	for resent := false; ; resent = true {
+		var err error
+		session, err = ntopngAuth.login(req.Context(), session, breaker)
+		if err != nil {
+			return nil, fmt.Errorf("request %s: %w", requestID, err)
+		}
+
+		resp, err := attemptNtopRequest(req, endpoint, breaker)
+		if errors.Is(err, errSessionExpired) && !resent {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("request %s: %w", requestID, err)
+		}
+		return resp, nil
+	}
+}
+
+// attemptNtopRequest sends req once through the rate limiter and breaker
+func attemptNtopRequest(req *http.Request, endpoint string, breaker *circuitBreaker) (*http.Response, error) {
+	if ntopngLimiter != nil {
+		// wait our turn rather than bursting at ntopng
+		err := ntopngLimiter.Wait(req.Context())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	probe, err := breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	// a hung attempt should fail and be retried rather than hold up the cycle.
+	// The context has to outlive this function since the caller still reads
+	// the body, so it is cancelled when the body is closed.
+	cancel := context.CancelFunc(func() {})
+	if ntopngAttemptTimeout > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithTimeout(req.Context(), ntopngAttemptTimeout)
+		req = req.WithContext(ctx)
+	}
+
+	requestStart := time.Now()
+	resp, err := sendNtopRequest(req)
+	ntopng_api_request_duration.WithLabelValues(endpoint).Observe(time.Since(requestStart).Seconds())
+	if err == nil {
+		err = checkResponseStatus(resp, endpoint)
+		if err != nil {
+			resp.Body.Close()
+		}
+	}
+
+	// an expired session still means ntopng is up and answering
+	if errors.Is(err, errSessionExpired) {
+		breaker.record(probe, nil)
+	} else {
+		breaker.record(probe, err)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels a request's context once its body has been closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func readResponseBody(resp *http.Response, maxResponseBytes int64, endpoint string) ([]byte, error) {
+	requestID := resp.Request.Header.Get(requestIDHeader)
+
+	// catch proxy error pages and misrouted requests before we even read them.
+	// ParseMediaType strips parameters, so "application/json; charset=utf-8" is
+	// fine. A missing header is let through to the body check below.
+	contentType := resp.Header.Get("Content-Type")
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil || mediaType != "application/json" {
+			return nil, fmt.Errorf("request %s: %w from %s: unexpected Content-Type %q", requestID, errNotJSON, resp.Request.URL, contentType)
+		}
+	}
+
+	// the transport asks for gzip and decompresses it for us, dropping the
+	// Content-Encoding header. If the header is still here, ntopng or a proxy
+	// compressed the body without being asked, so decompress it ourselves.
+	var reader io.Reader = resp.Body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("request %s: %w: %w", requestID, errReadBody, err)
+		}
+		defer gz.Close()
+		reader = gz
+	}
+
+	// cap how much we are willing to buffer so a runaway response can't
+	// exhaust memory. We read one byte past the limit so we can tell a body
+	// that fits exactly apart from one that was truncated. The cap applies
+	// after decompression.
+	body, err := io.ReadAll(io.LimitReader(reader, maxResponseBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("request %s: %w: %w", requestID, errReadBody, err)
+	}
+	ntopng_api_response_bytes.WithLabelValues(endpoint).Add(float64(len(body)))
+
+	if int64(len(body)) > maxResponseBytes {
+		return nil, fmt.Errorf("request %s: ntopng response from %s exceeded NTOPNG_MAX_RESPONSE_BYTES (%d bytes)", requestID, resp.Request.URL, maxResponseBytes)
+	}
 
+	// an expired session or the wrong port gets us an HTML login page with a
+	// 200, which gjson would happily turn into a page full of zeros
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, fmt.Errorf("request %s: %w from %s. This is usually an ntopng login page; check NTOPNG_USERNAME/NTOPNG_PASSWORD and that NTOPNG_API_URL/NTOPNG_API_PORT point at the ntopng API", requestID, errNotJSON, resp.Request.URL)
 	}
 
+	return body, nil
+}
+
+func queryNtopMetricsWithRetries(c config, ifid int) (string, error) {
+	return queryInterfaceData(c, ifid, ntopngBreaker)
+}
+
+// queryInterfaceData requests data.lua for one interface, consulting breaker
+// as doNtopRequestWithBreaker does
+func queryInterfaceData(c config, ifid int, breaker *circuitBreaker) (string, error) {
+	params := url.Values{}
+	params.Set("ifid", strconv.Itoa(ifid))
+
+	var url = ntopngAPIURL(c, "/get/interface/data.lua", params)
+
+	req, _ := http.NewRequest("GET", url, nil)
+
+	req.Header.Set("Authorization", "Basic "+c.basicAuthenticationToken)
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := doNtopRequestWithBreaker(req, endpointInterfaceData, breaker)
+	if err != nil {
+		errorLog.Printf("interface_data_request", "%v", err)
+		return "nil", err
+	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-
+	body, err := readResponseBody(resp, c.maxResponseBytes, endpointInterfaceData)
 	if err != nil {
-		log.Fatal(err)
+		errorLog.Printf("interface_data_read", "%v", err)
+		return "nil", err
 	}
+
 	return string(body), err
 
 }
@@ -165,9 +2437,21 @@ func queryNtopMetrics(c config, ifid int) (string, error) {
 	var err error
 	var waitTime int
 
-	for retries < 40 {
-		body, err = queryNtopMetricsWithRetries(c.ntopngFullUrl, c.basicAuthenticationToken, ifid)
+	start := retryNow()
+
+	for retries < maxRetries {
+		body, err = queryNtopMetricsWithRetries(c, ifid)
 		if err == nil {
+			if retries > 0 {
+				log.Printf("Recovered: Ntopng API query for interface time series data succeeded after %d retries.", retries)
+				ntopng_api_recoveries.WithLabelValues(endpointInterfaceData).Inc()
+			}
+			break
+		} else if !isRetryable(err) {
+			// bad credentials won't fix themselves, so don't sit in the backoff loop
+			if isAuthFailure(err) {
+				reportAuthFailure(endpointInterfaceData)
+			}
 			break
 		} else {
 			retries += 1
@@ -175,9 +2459,17 @@ func queryNtopMetrics(c config, ifid int) (string, error) {
 			// iteration
 			waitTime = 1 * int(math.Pow(1.2, float64(retries)))
 
-			log.Printf("Error: Unable to query Ntopng API for interface time series data. Retrying with %d second backoff.", waitTime)
+			backoff, ok := retryBackoff(start, time.Duration(waitTime)*time.Second, c.retryDeadline)
+			if !ok {
+				errorLog.Printf("interface_data_deadline", "Error: Unable to query Ntopng API for interface time series data: %v. Giving up after NTOPNG_RETRY_DEADLINE_SECONDS (%s).", err, c.retryDeadline)
+				break
+			}
+
+			ntopng_api_retries.WithLabelValues(endpointInterfaceData).Inc()
+			ntopng_retry_reasons.WithLabelValues(retryReason(err)).Inc()
+			errorLog.Printf("interface_data_retry", "Error: Unable to query Ntopng API for interface time series data: %v. Retrying with %s backoff.", err, backoff)
 
-			time.Sleep(time.Duration(waitTime) * time.Second)
+			retrySleep(backoff)
 		}
 	}
 
@@ -185,46 +2477,133 @@ func queryNtopMetrics(c config, ifid int) (string, error) {
 
 }
 
-func enumerateInterfaceIDsWithRetries(ntopngFullUrl string, basicAuthenticationToken string) ([]int, error) {
-	// hit ntopng to enumerate all interface IDs and put into a slice
-	// https://www.ntop.org/guides/ntopng/api/rest/examples_v2.html#interfaces
+// maxEnumerationPages bounds how many pages of a paginated interfaces.lua
+// response we follow, in case ntopng keeps handing out pages
+const maxEnumerationPages = 100
+
+// fetchInterfacesPage requests one page of interfaces.lua. Pages are numbered
+// from 1; page 0 requests the endpoint without pagination parameters, which is
+// all ntopng needs unless it paginates its answer.
+func fetchInterfacesPage(c config, page int, breaker *circuitBreaker) (string, error) {
+	params := url.Values{}
+	if page > 0 {
+		params.Set("currentPage", strconv.Itoa(page))
+	}
 
-	var url = ntopngFullUrl + "/lua/rest/v2/get/ntopng/interfaces.lua"
+	var url = ntopngAPIURL(c, "/get/ntopng/interfaces.lua", params)
 
 	req, _ := http.NewRequest("GET", url, nil)
 
-	req.Header.Set("Authorization", "Basic "+basicAuthenticationToken)
-
-	client := &http.Client{}
+	req.Header.Set("Authorization", "Basic "+c.basicAuthenticationToken)
+	req.Header.Set("User-Agent", c.userAgent)
 
-	resp, err := client.Do(req)
+	resp, err := doNtopRequestWithBreaker(req, endpointInterfaces, breaker)
 	if err != nil {
-		log.Println(err)
-		return nil, err
+		return "", err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := readResponseBody(resp, c.maxResponseBytes, endpointInterfaces)
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
 
+	return string(body), nil
+}
+
+// aggregateViewIfname is the ifname of ntopng's view interface. In cases where
+// the view:all interface is enabled, we do not wish to export it since that
+// creates situations where the prom sum() function unintuitively returns
+// doubled values. Enumeration must never return it.
+const aggregateViewIfname = "view:all"
+
+func enumerateInterfaceIDsWithRetries(c config) ([]int, error) {
+	interfaces, names, err := listInterfaces(c, ntopngBreaker)
+	if err != nil {
+		errorLog.Printf("interfaces_error", "%v", err)
+		return nil, err
+	}
+
+	setInterfaceNames(names)
+
+	return interfaces, nil
+}
+
+// listInterfaces asks ntopng for its interfaces and returns their ifids along
+// with their names. Unlike enumerateInterfaceIDsWithRetries it records nothing,
+// so diagnostics can call it without disturbing the scraper's view of ntopng.
+// breaker is consulted as doNtopRequestWithBreaker does.
+func listInterfaces(c config, breaker *circuitBreaker) ([]int, map[int]string, error) {
+	// NTOPNG_INTERFACE_IDS replaces enumeration altogether. We don't learn the
+	// interface names that way, so ifname labels are left empty.
+	if len(c.interfaceIDs) > 0 {
+		return append([]int(nil), c.interfaceIDs...), make(map[int]string), nil
+	}
+
+	// hit ntopng to enumerate all interface IDs and put into a slice
+	// https://www.ntop.org/guides/ntopng/api/rest/examples_v2.html#interfaces
+
 	var interfaces []int
+	names := make(map[int]string)
+	// ntopng can list an ifid more than once, e.g. when an interface shows up in
+	// several views. Scraping it twice would double-count its counters.
+	seen := make(map[int]bool)
+
+	addInterfaces := func(list gjson.Result) {
+		list.ForEach(func(key, value gjson.Result) bool {
+			ifname := gjson.Get(value.String(), "ifname").Str
+			if ifname != aggregateViewIfname {
+				ifid := int(gjson.Get(value.String(), "ifid").Int())
+				if seen[ifid] {
+					log.Printf("ntopng listed interface %d (%s) more than once. Ignoring the duplicate", ifid, ifname)
+					return true
+				}
+				seen[ifid] = true
+				interfaces = append(interfaces, ifid)
+				names[ifid] = ifname
+			}
+			return true // keep iterating
+		})
+	}
+
+	body, err := fetchInterfacesPage(c, 0, breaker)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// ntopng normally answers with the interfaces as a plain array under rsp.
+	// Paginated answers use the same envelope as its other paged endpoints:
+	// rsp.data holds the page, alongside rsp.currentPage and rsp.totalRows.
+	if !gjson.Get(body, "rsp.data").Exists() {
+		addInterfaces(gjson.Get(body, "rsp"))
+		return interfaces, names, nil
+	}
+
+	// rows counts everything ntopng listed, including view:all, so it can be
+	// compared against totalRows
+	var rows int
+	for pages := 1; ; pages++ {
+		page := gjson.Get(body, "rsp.data")
+		addInterfaces(page)
+		rows += len(page.Array())
 
-	result := gjson.Get(string(body), "rsp")
-	result.ForEach(func(key, value gjson.Result) bool {
-		// In cases where the view:all interface is enabled, we do not wish to
-		// export the view:all interface since that creates situations where the
-		// prom sum() function unintuitively returns doubled values
-		if gjson.Get(value.String(), "ifname").Str != "view:all" {
-			retVal := gjson.Get(value.String(), "ifid")
-			interfaces = append(interfaces, int(retVal.Int()))
+		totalRows := int(gjson.Get(body, "rsp.totalRows").Int())
+		if len(page.Array()) == 0 || rows >= totalRows {
+			break
+		}
+		if pages >= maxEnumerationPages {
+			log.Printf("Error: ntopng interface list still incomplete after %d pages (%d of %d rows). Using what we have", pages, rows, totalRows)
+			break
 		}
-		return true // keep iterating
-	})
 
-	return interfaces, err
+		// pages are numbered from 1, so the next one is pages+1
+		body, err = fetchInterfacesPage(c, pages+1, breaker)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
+	return interfaces, names, nil
 }
 
 func enumerateInterfaceIDs(c config) ([]int, error) {
@@ -234,9 +2613,23 @@ func enumerateInterfaceIDs(c config) ([]int, error) {
 	var err error
 	var waitTime int
 
-	for retries < 40 {
-		interfaces, err = enumerateInterfaceIDsWithRetries(c.ntopngFullUrl, c.basicAuthenticationToken)
+	start := retryNow()
+
+	for retries < maxRetries {
+		interfaces, err = enumerateInterfaceIDsWithRetries(c)
 		if err == nil {
+			if retries > 0 {
+				log.Printf("Recovered: Ntopng API query for interface data succeeded after %d retries.", retries)
+				ntopng_api_recoveries.WithLabelValues(endpointInterfaces).Inc()
+			}
+			break
+		} else if !isRetryable(err) && !errors.Is(err, errCircuitOpen) {
+			// bad credentials won't fix themselves, so don't sit in the backoff loop.
+			// An open breaker is different here: without an interface list the
+			// scraper has nothing to do, so keep backing off until it half-opens.
+			if isAuthFailure(err) {
+				reportAuthFailure(endpointInterfaces)
+			}
 			break
 		} else {
 			retries += 1
@@ -244,9 +2637,17 @@ func enumerateInterfaceIDs(c config) ([]int, error) {
 			// iteration
 			waitTime = 1 * int(math.Pow(1.2, float64(retries)))
 
-			log.Printf("Error: Unable to query Ntopng API for interface data. Retrying with %d second backoff.", waitTime)
+			backoff, ok := retryBackoff(start, time.Duration(waitTime)*time.Second, c.retryDeadline)
+			if !ok {
+				errorLog.Printf("interfaces_deadline", "Error: Unable to query Ntopng API for interface data: %v. Giving up after NTOPNG_RETRY_DEADLINE_SECONDS (%s).", err, c.retryDeadline)
+				break
+			}
+
+			ntopng_api_retries.WithLabelValues(endpointInterfaces).Inc()
+			ntopng_retry_reasons.WithLabelValues(retryReason(err)).Inc()
+			errorLog.Printf("interfaces_retry", "Error: Unable to query Ntopng API for interface data: %v. Retrying with %s backoff.", err, backoff)
 
-			time.Sleep(time.Duration(waitTime) * time.Second)
+			retrySleep(backoff)
 		}
 	}
 
@@ -254,10 +2655,400 @@ func enumerateInterfaceIDs(c config) ([]int, error) {
 
 }
 
-func calculateCounterVal(promMetricVal uint64, ntopMetricValInt uint64) (uint64, uint64) {
+// capInterfaces trims interfaces to the first maxInterfaces entries so a
+// misbehaving ntopng can't blow up our label cardinality. A maxInterfaces of 0
+// means no limit.
+func capInterfaces(interfaces []int, maxInterfaces int) []int {
+	if maxInterfaces <= 0 || len(interfaces) <= maxInterfaces {
+		return interfaces
+	}
+
+	dropped := len(interfaces) - maxInterfaces
+	log.Printf("Warning: ntopng reported %d interfaces, which exceeds MAX_INTERFACES (%d). Only scraping the first %d", len(interfaces), maxInterfaces, maxInterfaces)
+	ntopng_interfaces_dropped.Add(float64(dropped))
+
+	return interfaces[:maxInterfaces]
+}
+
+// publishNtopngVersion looks up the ntopng version reported alongside the
+// interface data and exports it as ntopng_info{version}. ntopng releases that
+// don't report a version are exported as "unknown".
+func publishNtopngVersion(c config, ifid int) {
+	body, err := queryNtopMetricsWithRetries(c, ifid)
+	if err != nil {
+		log.Println("Error: Unable to look up ntopng version:", err)
+		return
+	}
+
+	version := gjson.Get(body, "rsp.version").String()
+	if version == "" {
+		version = "unknown"
+	}
+
+	log.Println("ntopng version:", version)
+	ntopng_info.Reset()
+	ntopng_info.WithLabelValues(version).Set(1)
+}
+
+// missingFields returns the ntopng paths of the given metrics that are absent
+// from body
+func missingFields(c config, body string, metricNames []string) []string {
+	var missing []string
+	for _, metricName := range metricNames {
+		val, metricPath := lookupStat(body, c.statsBasePath, metricField(c, metricName))
+		if !val.Exists() {
+			missing = append(missing, metricPath)
+		}
+	}
+	return missing
+}
+
+// checkSchema enforces STRICT_SCHEMA: if any of the metrics is missing from
+// ntopng's response for ifid, it logs loudly, counts each missing field and
+// returns false so the caller skips the whole interface. Without STRICT_SCHEMA
+// it always returns true and missing fields are skipped one by one.
+func checkSchema(c config, body string, ifid int, metricNames []string) bool {
+	if !c.strictSchema {
+		return true
+	}
+
+	missing := missingFields(c, body, metricNames)
+	if len(missing) == 0 {
+		return true
+	}
+
+	errorLog.Printf("strict_schema", "Error: STRICT_SCHEMA: ntopng response for interface %d is missing %s. Has ntopng changed its API? Skipping interface", ifid, strings.Join(missing, ", "))
+	for _, field := range missing {
+		ntopng_schema_violations.WithLabelValues(field).Inc()
+	}
+	ntopng_scrape_errors.WithLabelValues(fmt.Sprintf("%d", ifid), "schema").Inc()
+	skipInterface(ifid, "schema", nil)
+	return false
+}
+
+// lookupStat returns the value of field under basePath in body, along with the
+// path it was found at. Some ntopng releases nest counters one level down under
+// a "counters" object, so if field isn't directly under basePath we look there
+// too. If neither exists the returned result's Exists() is false.
+func lookupStat(body string, basePath string, field string) (gjson.Result, string) {
+	path := basePath + "." + field
+	val := gjson.Get(body, path)
+	if val.Exists() {
+		return val, path
+	}
+
+	nestedPath := basePath + ".counters." + field
+	nestedVal := gjson.Get(body, nestedPath)
+	if nestedVal.Exists() {
+		return nestedVal, nestedPath
+	}
+
+	return val, path
+}
+
+// updateMsgPerFlow sets ntopng_zmq_msg_per_flow from the raw message and flow
+// counters in body, zmq_msg_rcvd and flows unless MSG_PER_FLOW_MESSAGES_FIELD
+// or MSG_PER_FLOW_FLOWS_FIELD say otherwise. When ntopng hasn't seen any flows
+// yet the ratio is undefined, and when either field is missing it would be
+// meaningless, so the gauge is left alone rather than reporting a misleading
+// value.
+func updateMsgPerFlow(c config, body string, hostname string, ifid int) {
+	msgs, msgsPath := lookupStat(body, c.statsBasePath, c.msgPerFlowMessagesField)
+	flows, flowsPath := lookupStat(body, c.statsBasePath, c.msgPerFlowFlowsField)
+	if !msgs.Exists() || !flows.Exists() {
+		missing := msgsPath
+		if msgs.Exists() {
+			missing = flowsPath
+		}
+		errorLog.Printf("msg_per_flow_missing", "Error: %s missing from ntopng response for interface %d. Skipping ntopng_zmq_msg_per_flow", missing, ifid)
+		ntopng_scrape_errors.WithLabelValues(fmt.Sprintf("%d", ifid), "missing_field").Inc()
+		return
+	}
+	if flows.Float() == 0 {
+		return
+	}
+
+	ntopng_zmq_msg_per_flow.WithLabelValues(hostname, fmt.Sprintf("%d", ifid)).Set(msgs.Float() / flows.Float())
+}
+
+// lastEnumeration is when interface enumeration last succeeded, as Unix
+// nanoseconds. Until the first success it holds the exporter's start time, so
+// ntopng_seconds_since_last_enumeration climbs from startup.
+var lastEnumeration atomic.Int64
+
+func init() {
+	lastEnumeration.Store(time.Now().UnixNano())
+}
+
+var (
+	ntopng_seconds_since_last_enumeration = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ntopng_seconds_since_last_enumeration",
+		Help: "Seconds since ntopng interfaces were last enumerated successfully, or since the exporter started if they never were.",
+	}, func() float64 {
+		return time.Since(time.Unix(0, lastEnumeration.Load())).Seconds()
+	})
+)
+
+// interfaceNames remembers the ifname ntopng reported for each ifid during
+// enumeration, so metrics can carry it even when a scrape of that interface
+// fails.
+var (
+	interfaceNamesMu sync.RWMutex
+	interfaceNames   = make(map[int]string)
+)
+
+func setInterfaceNames(names map[int]string) {
+	// only called once enumeration has succeeded
+	lastEnumeration.Store(time.Now().UnixNano())
+
+	interfaceNamesMu.Lock()
+	defer interfaceNamesMu.Unlock()
+	interfaceNames = names
+}
+
+func interfaceName(ifid int) string {
+	interfaceNamesMu.RLock()
+	defer interfaceNamesMu.RUnlock()
+	return interfaceNames[ifid]
+}
+
+// ifnameUnsafeRE matches runs of characters we don't put in ifname labels
+var ifnameUnsafeRE = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// sanitizeIfname turns an ntopng interface name into a consistent label value
+// by replacing every run of non-alphanumeric characters with a single
+// underscore, e.g. "view:all" becomes "view_all" and "eth0 (mirror)" becomes
+// "eth0_mirror_". The name as ntopng reported it goes in the ifname_raw label.
+func sanitizeIfname(name string) string {
+	return ifnameUnsafeRE.ReplaceAllString(name, "_")
+}
+
+// setInterfaceUp records whether the last scrape of ifid succeeded
+func setInterfaceUp(ifid int, up bool) {
+	var val float64
+	if up {
+		val = 1
+	}
+	name := interfaceName(ifid)
+	ntopng_interface_up.WithLabelValues(fmt.Sprintf("%d", ifid), sanitizeIfname(name), name).Set(val)
+	if up {
+		setLastScrapeError(ifid, "")
+	}
+}
+
+// setLastScrapeError replaces ifid's ntopng_last_scrape_error series with one
+// for category, or just clears it if category is empty
+func setLastScrapeError(ifid int, category string) {
+	ntopng_last_scrape_error.DeletePartialMatch(prometheus.Labels{"ifid": fmt.Sprintf("%d", ifid)})
+	if category != "" {
+		ntopng_last_scrape_error.WithLabelValues(fmt.Sprintf("%d", ifid), category).Set(1)
+	}
+}
+
+// skipInterface marks ifid down for a cycle in which it was skipped and counts
+// why in ntopng_interfaces_skipped_total. err is the error from querying
+// ntopng, if that is why. Failed requests are reported in
+// ntopng_last_scrape_error by the same categories as retries rather than the
+// raw error text, which would make for unbounded label values.
+func skipInterface(ifid int, reason string, err error) {
+	ntopng_interfaces_skipped.WithLabelValues(fmt.Sprintf("%d", ifid), reason).Inc()
+	setInterfaceUp(ifid, false)
+
+	category := reason
+	if reason == "request" && err != nil {
+		category = retryReason(err)
+	}
+	setLastScrapeError(ifid, category)
+}
+
+// forgetInterface deletes every series exported for ifid, for an interface
+// that ntopng no longer lists. Otherwise its last values would be exported as
+// if they were current until the exporter restarts.
+func forgetInterface(ifid int) {
+	ifidLabel := prometheus.Labels{"ifid": fmt.Sprintf("%d", ifid)}
+	for _, metric := range zmqMetrics {
+		if metric.counter != nil {
+			metric.counter.DeletePartialMatch(ifidLabel)
+		}
+		if metric.gauge != nil {
+			metric.gauge.DeletePartialMatch(ifidLabel)
+		}
+		if metric.raw != nil {
+			metric.raw.DeletePartialMatch(ifidLabel)
+		}
+	}
+	ntopng_zmq_msg_per_flow.DeletePartialMatch(ifidLabel)
+	ntopng_metric_rate.DeletePartialMatch(ifidLabel)
+	ntopng_interface_up.DeletePartialMatch(ifidLabel)
+	ntopng_last_scrape_error.DeletePartialMatch(ifidLabel)
+	ntopng_host_bytes.DeletePartialMatch(ifidLabel)
+	delete(exportedHosts, ifid)
+	ntopng_active_alerts.DeletePartialMatch(ifidLabel)
+	ntopng_timeseries_latest.DeletePartialMatch(ifidLabel)
+}
+
+// NtopClient is the part of the ntopng API the scraper depends on. It exists so
+// the scraper loop can be driven by something other than a live ntopng.
+type NtopClient interface {
+	// EnumerateInterfaceIDs returns the ids of the interfaces to scrape
+	EnumerateInterfaceIDs() ([]int, error)
+	// QueryInterfaceData returns the raw data.lua response for ifid
+	QueryInterfaceData(ifid int) (string, error)
+}
+
+// ntopngAPIClient is the NtopClient backed by the ntopng REST API, with retries
+type ntopngAPIClient struct {
+	conf config
+}
+
+func (n *ntopngAPIClient) EnumerateInterfaceIDs() ([]int, error) {
+	return enumerateInterfaceIDs(n.conf)
+}
+
+func (n *ntopngAPIClient) QueryInterfaceData(ifid int) (string, error) {
+	return queryNtopMetrics(n.conf, ifid)
+}
+
+// maxRetries is how many times a single ntopng call is attempted before we
+// give up on it
+const maxRetries = 40
+
+// scrapeInterval is how often the scraper starts a cycle. It is a variable so
+// tests can run cycles back to back.
+var scrapeInterval = 2 * time.Second
+
+// cycleDurationAlpha is the weight of the latest cycle in the moving average
+// of cycle durations
+const cycleDurationAlpha = 0.2
+
+// cycleSucceeded reports whether a cycle that scraped scraped of total
+// interfaces counts as successful. A few misbehaving interfaces shouldn't
+// fail the whole cycle, but a cycle that scraped nothing never succeeds.
+func cycleSucceeded(scraped int, total int, minFraction float64) bool {
+	if total == 0 || scraped == 0 {
+		return false
+	}
+	return float64(scraped)/float64(total) >= minFraction
+}
+
+// slowCycleWarningInterval rate limits the warning logged while the average
+// cycle takes longer than scrapeInterval
+const slowCycleWarningInterval = 10 * time.Minute
+
+// retrySleep and retryNow are how the retry loops wait between attempts and
+// measure NTOPNG_RETRY_DEADLINE_SECONDS. They are variables so the backoff
+// schedule can be driven by a fake clock instead of ~25 minutes of real
+// sleeping.
+var (
+	retrySleep = time.Sleep
+	retryNow   = time.Now
+)
+
+// retryBackoff trims backoff so we don't sleep past deadline, measured from
+// start. It returns false once the deadline has passed and the caller should
+// give up. A deadline of 0 means retries are only bounded by their count.
+func retryBackoff(start time.Time, backoff time.Duration, deadline time.Duration) (time.Duration, bool) {
+	if deadline <= 0 {
+		return backoff, true
+	}
+
+	remaining := deadline - retryNow().Sub(start)
+	if remaining <= 0 {
+		return 0, false
+	}
+	if backoff > remaining {
+		return remaining, true
+	}
+	return backoff, true
+}
+
+// recoverScraperPanic is deferred around each scrape cycle. It logs the panic
+// with its stack and counts it, so the scraper carries on with the next cycle.
+func recoverScraperPanic(cycleID string) {
+	if r := recover(); r != nil {
+		log.Printf("[cycle %s] Error: scraper panicked: %v\n%s", cycleID, r, debug.Stack())
+		ntopng_scraper_panics.Inc()
+	}
+}
+
+// enumerationRetryInterval is how long enumerateUntilSuccess waits after
+// client.EnumerateInterfaceIDs has given up before starting over
+const enumerationRetryInterval = time.Minute
+
+// reportZeroInterfaces handles an enumeration that succeeded without finding
+// any interfaces to scrape, as ZERO_INTERFACES_BEHAVIOR says. It only returns
+// if we are to wait and enumerate again.
+func reportZeroInterfaces(c config, retryIn time.Duration) {
+	ntopng_empty_enumerations.Inc()
+	if c.zeroInterfacesBehavior == zeroInterfacesFail {
+		log.Fatalf("Error: ntopng has no interfaces to scrape and ZERO_INTERFACES_BEHAVIOR is %s. Exiting.", zeroInterfacesFail)
+	}
+	log.Printf("ntopng has no interfaces to scrape. Enumerating again in %s", retryIn)
+}
+
+// enumerateUntilSuccess calls client.EnumerateInterfaceIDs, which has its own
+// backoff, until it finds interfaces or ctx is cancelled, and sends the result
+// on enumerated.
+func enumerateUntilSuccess(ctx context.Context, conf config, client NtopClient, enumerated chan<- []int) {
+	for {
+		interfaces, err := client.EnumerateInterfaceIDs()
+		if err == nil && len(interfaces) > 0 {
+			enumerated <- interfaces
+			return
+		}
+
+		if err == nil {
+			reportZeroInterfaces(conf, enumerationRetryInterval)
+		} else {
+			log.Printf("oh no. error hitting ntopng api for interface data! Trying again in %s", enumerationRetryInterval)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(enumerationRetryInterval):
+		}
+	}
+}
+
+// reenumeratePeriodically enumerates the ntopng interfaces every
+// ENUMERATION_INTERVAL_SECONDS until ctx is cancelled and sends each result on
+// enumerated, so the scraper picks up interfaces added to or removed from
+// ntopng. A failed or empty enumeration keeps the current list.
+func reenumeratePeriodically(ctx context.Context, conf config, client NtopClient, enumerated chan<- []int) {
+	ticker := time.NewTicker(conf.enumerationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		interfaces, err := client.EnumerateInterfaceIDs()
+		if err != nil {
+			errorLog.Printf("reenumeration_error", "Error: Unable to re-enumerate ntopng interfaces. Keeping the current list: %v", err)
+			continue
+		}
+		if len(interfaces) == 0 {
+			reportZeroInterfaces(conf, conf.enumerationInterval)
+			continue
+		}
+
+		select {
+		case enumerated <- interfaces:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func calculateCounterVal(promMetricVal uint64, ntopMetricValInt uint64) (uint64, uint64, bool) {
 
 	var toAdd uint64 = 0
 	var counterVal uint64
+	var reset bool
 	if promMetricVal < ntopMetricValInt {
 		// normal incrementing behvaior of the metricVal
 		toAdd = ntopMetricValInt - promMetricVal
@@ -268,144 +3059,472 @@ func calculateCounterVal(promMetricVal uint64, ntopMetricValInt uint64) (uint64,
 		log.Println("counterVal reset detected. Handling appropriately...")
 		toAdd = ntopMetricValInt
 		counterVal = ntopMetricValInt
+		reset = true
 
 	} else {
 		// this is the case where counterVal == ntopMetricValInt which is a noop
 		counterVal = ntopMetricValInt
 	}
 
-	return counterVal, toAdd
+	return counterVal, toAdd, reset
 
 }
 
-func scraper(ctx context.Context, name string, conf config) {
+func scraper(ctx context.Context, name string, conf config, client NtopClient) {
+	ntopng_scraper_running.Set(1)
+	// deferred so the gauge also drops if the loop exits for any other reason
+	defer ntopng_scraper_running.Set(0)
 
 	var interfaces []int
-	var err error
-	interfaces, err = enumerateInterfaceIDs(conf)
 
-	if err != nil {
-		log.Println("oh no. error hitting ntopng api for interface data!")
+	// enumeration keeps retrying in the background until it succeeds, so the
+	// loop below can pick up the interface list whenever it arrives. After
+	// that it repeats every ENUMERATION_INTERVAL_SECONDS.
+	enumerated := make(chan []int, 1)
+	go func() {
+		enumerateUntilSuccess(ctx, conf, client, enumerated)
+		if conf.enumerationInterval > 0 {
+			reenumeratePeriodically(ctx, conf, client, enumerated)
+		}
+	}()
+
+	// the list as ntopng last reported it, before MAX_INTERFACES
+	var lastFound []int
+	useInterfaces := func(found []int) {
+		lastFound = found
+		interfaces = capInterfaces(found, conf.maxInterfaces)
+		if len(interfaces) > 0 {
+			publishNtopngVersion(conf, interfaces[0])
+		}
+	}
+
+	var startupTimeout <-chan time.Time
+	if conf.startupEnumTimeout > 0 {
+		startupTimeout = time.After(conf.startupEnumTimeout)
+	}
+
+	select {
+	case found := <-enumerated:
+		useInterfaces(found)
+	case <-startupTimeout:
+		if conf.startupEnumFailureMode == startupEnumFailureExit {
+			log.Fatalf("Error: Unable to enumerate ntopng interfaces within STARTUP_ENUM_TIMEOUT_SECONDS (%s). Exiting.", conf.startupEnumTimeout)
+		}
+		log.Printf("Error: Unable to enumerate ntopng interfaces within STARTUP_ENUM_TIMEOUT_SECONDS (%s). Continuing to retry in the background.", conf.startupEnumTimeout)
+	case <-ctx.Done():
+		fmt.Println(name, "is stopping")
+		return
 	}
 
-	// initialization of map with empy slices in it
-	metricsMap := make(map[string][]uint64)
+	// metricsMap holds the last ntopng value we saw for each metric, keyed by
+	// ifid. Keying by ifid rather than by position in the interface list keeps
+	// the deltas correct if the interface list changes order or membership. An
+	// ifid we haven't seen yet reads as 0, same as a freshly started exporter.
+	metricsMap := make(map[string]map[int]uint64)
 
-	metricsMap["zmq_msg_rcvd"] = []uint64{}
-	metricsMap["dropped_flows"] = []uint64{}
-	metricsMap["zmq_msg_drops"] = []uint64{}
-	metricsMap["zmq_avg_msg_flows"] = []uint64{}
+	// lastSampled holds when each value in metricsMap was read, for the rate
+	// gauges. No entry means we have no previous sample to compute a rate from.
+	lastSampled := make(map[string]map[int]time.Time)
 
-	// initialization of slices; creates as many elements as we have interface IDs
-	for i := 0; i < len(interfaces); i++ {
-		metricsMap["zmq_msg_rcvd"] = append(metricsMap["zmq_msg_rcvd"], 0)
-		metricsMap["dropped_flows"] = append(metricsMap["dropped_flows"], 0)
-		metricsMap["zmq_msg_drops"] = append(metricsMap["zmq_msg_drops"], 0)
-		metricsMap["zmq_avg_msg_flows"] = append(metricsMap["zmq_avg_msg_flows"], 0)
+	var scrapedMetrics []string
+	for metricName := range zmqMetrics {
+		if conf.disabledMetrics[metricName] {
+			continue
+		}
+		scrapedMetrics = append(scrapedMetrics, metricName)
+		metricsMap[metricName] = make(map[int]uint64)
+		lastSampled[metricName] = make(map[int]time.Time)
 	}
+	sort.Strings(scrapedMetrics)
+
+	// cycles start on ticks rather than a fixed sleep after the previous cycle,
+	// so slow cycles don't push every later one back. time.Ticker drops ticks
+	// a slow receiver misses, so an overrunning cycle is followed immediately by
+	// the next one rather than by a burst of catch-up cycles.
+	ticker := time.NewTicker(scrapeInterval)
+	defer ticker.Stop()
+
+	// moving average of cycle durations, and when we last warned about it
+	var avgCycleDuration time.Duration
+	var lastSlowCycleWarning time.Time
 
 	for {
 		select {
 		case <-ctx.Done():
 			fmt.Println(name, "is stopping")
 			return
-		default:
-			var metricVal uint64
-			var toAdd uint64
+		case found := <-enumerated:
+			// startup enumeration finished after STARTUP_ENUM_TIMEOUT_SECONDS, or
+			// a periodic re-enumeration came back
+			if slices.Equal(found, lastFound) {
+				continue
+			}
+			log.Printf("Enumerated %d ntopng interfaces in the background: %v", len(found), found)
+			previous := interfaces
+			useInterfaces(found)
+
+			// an interface that is back later starts over, same as on a freshly
+			// started exporter
+			for _, ifid := range previous {
+				if slices.Contains(interfaces, ifid) {
+					continue
+				}
+				log.Printf("ntopng interface %d is no longer scraped. Deleting its series", ifid)
+				forgetInterface(ifid)
+				for metricName := range metricsMap {
+					delete(metricsMap[metricName], ifid)
+					delete(lastSampled[metricName], ifid)
+				}
+			}
+		case <-ticker.C:
+			cycleStart := time.Now()
+
+			// tag this cycle's log lines so they can be grouped together
+			cycleID := newCorrelationID()
 
-			// sleep between iterations
-			time.Sleep(2 * time.Second)
+			// a panic, e.g. from a payload we didn't anticipate, costs us this
+			// cycle rather than the whole process
+			func() {
+				defer recoverScraperPanic(cycleID)
 
-			log.Println("metrics map:", metricsMap)
+				var metricVal uint64
+				var toAdd uint64
+				// interfaces scraped successfully this cycle
+				var scrapedInterfaces int
 
-			// iterate over all the metrics we care about
-			for metricName := range metricsMap {
+				log.Printf("[cycle %s] metrics map: %v", cycleID, metricsMap)
+
+				hostname, err := os.Hostname()
+				if err != nil {
+					log.Println("oh no. Unable to detect what your hostname is :shrug:")
+				}
 
-				// loop over all ntopng interfaces
+				// loop over all ntopng interfaces, querying each one once per cycle
 				for i := 0; i < len(interfaces); i++ {
+					// spread the cycle's requests out rather than bursting at ntopng
+					if conf.scrapeBatchSize > 0 && i > 0 && i%conf.scrapeBatchSize == 0 {
+						time.Sleep(conf.scrapeBatchGap)
+					}
 
 					var body string
 
-					body, err = queryNtopMetrics(conf, interfaces[i])
+					body, err = client.QueryInterfaceData(interfaces[i])
 					if err != nil {
-						log.Println("oh no. error hitting ntopng api for metrics data!")
+						// don't feed an error body into the counter logic; it would
+						// look like a counter reset to 0
+						errorLog.Printf("interface_data_error", "[cycle %s] oh no. error hitting ntopng api for metrics data for interface %d! %v", cycleID, interfaces[i], err)
+						reason := "request"
+						if errors.Is(err, errNotJSON) {
+							reason = "not_json"
+						}
+						ntopng_scrape_errors.WithLabelValues(fmt.Sprintf("%d", interfaces[i]), reason).Inc()
+						skipInterface(interfaces[i], reason, err)
+						continue
+					}
+
+					// ntopng wraps responses as {"rc":N,"rsp":...}. A non-zero rc means
+					// rsp is missing or meaningless, so reading from it would just give us
+					// zeros.
+					rc := gjson.Get(body, "rc")
+					if rc.Exists() && rc.Int() != 0 {
+						errorLog.Printf("interface_data_rc", "[cycle %s] Error: ntopng returned rc=%d (%s) for interface %d. Skipping interface", cycleID, rc.Int(), gjson.Get(body, "rc_str").String(), interfaces[i])
+						ntopng_scrape_errors.WithLabelValues(fmt.Sprintf("%d", interfaces[i]), "rc").Inc()
+						skipInterface(interfaces[i], "rc", nil)
+						continue
 					}
 
 					if body == "1" {
-						log.Println("Error: Skipping interface")
+						errorLog.Printf("interface_data_invalid_body", "[cycle %s] Error: Skipping interface %d", cycleID, interfaces[i])
+						skipInterface(interfaces[i], "invalid_body", nil)
 						continue
 					}
 
-					ntopMetricVal := gjson.Get(body, fmt.Sprintf("rsp.zmqRecvStats.%s", metricName))
+					if !checkSchema(conf, body, interfaces[i], scrapedMetrics) {
+						continue
+					}
 
-					ntopMetricValInt := uint64(ntopMetricVal.Int())
+					setInterfaceUp(interfaces[i], true)
+					scrapedInterfaces += 1
+
+					// the raw ntopng values, for /stats.json
+					scraped := make(map[string]float64)
+
+					// iterate over all the metrics we care about
+					for metricName := range metricsMap {
+
+						metric, ok := zmqMetrics[metricName]
+						if !ok {
+							log.Println("Error: Invalid data! :(")
+							continue
+						}
+
+						ntopMetricVal, metricPath := lookupStat(body, conf.statsBasePath, metricField(conf, metricName))
+
+						// gjson hands back 0 for a path that doesn't exist. A missing field is
+						// not a counter reset, so leave the metric alone this cycle.
+						if !ntopMetricVal.Exists() {
+							errorLog.Printf("missing_field", "[cycle %s] Error: %s missing from ntopng response for interface %d. Skipping metric", cycleID, metricPath, interfaces[i])
+							ntopng_scrape_errors.WithLabelValues(fmt.Sprintf("%d", interfaces[i]), "missing_field").Inc()
+							continue
+						}
+
+						scraped[metricName] = ntopMetricVal.Float()
+
+						if metric.raw != nil {
+							metric.raw.WithLabelValues(hostname, fmt.Sprintf("%d", interfaces[i])).Set(ntopMetricVal.Float())
+						}
+
+						// gauges take ntopng's value as is; the counter-delta and reset
+						// handling below only makes sense for counters
+						if metric.gauge != nil {
+							metric.gauge.WithLabelValues(hostname, fmt.Sprintf("%d", interfaces[i])).Set(roundValue(conf, metricName, ntopMetricVal.Float()))
+							continue
+						}
+
+						ntopMetricValInt := uint64(ntopMetricVal.Int())
+
+						// unfortuantley, counter metrics do not have a `set` method. As a result
+						// we have to do a little rigamarole to
+						// a) only add if we have updates AND
+						// b) calculate the correct amount to add
+						var reset bool
+						metricVal, toAdd, reset = calculateCounterVal(metricsMap[metricName][interfaces[i]], ntopMetricValInt)
+						if reset {
+							ntopng_counter_resets.WithLabelValues(metricName, fmt.Sprintf("%d", interfaces[i])).Inc()
+						}
+
+						metricsMap[metricName][interfaces[i]] = metricVal
+
+						now := time.Now()
+						previousSample, sampledBefore := lastSampled[metricName][interfaces[i]]
+						lastSampled[metricName][interfaces[i]] = now
+						// after a reset we don't know how long ntopng has been counting
+						// from 0, so skip the rate rather than report a bogus one
+						if rateMetrics[metricName] && sampledBefore && !reset {
+							elapsed := now.Sub(previousSample).Seconds()
+							if elapsed > 0 {
+								ntopng_metric_rate.WithLabelValues(hostname, fmt.Sprintf("%d", interfaces[i]), metricName).Set(float64(toAdd) / elapsed)
+							}
+						}
+
+						// now update our metrics:
+						counter := metric.counter.WithLabelValues(hostname, fmt.Sprintf("%d", interfaces[i]))
+						if conf.enableExemplars && toAdd > 0 {
+							// tie this increment back to the cycle's log lines
+							counter.(prometheus.ExemplarAdder).AddWithExemplar(float64(toAdd), prometheus.Labels{"cycle_id": cycleID})
+						} else {
+							counter.Add(float64(toAdd))
+						}
+					}
 
-					// unfortuantley, counter metrics do not have a `set` method. As a result
-					// we have to do a little rigamarole to
-					// a) only add if we have updates AND
-					// b) calculate the correct amount to add
-					metricVal, toAdd = calculateCounterVal(metricsMap[metricName][i], ntopMetricValInt)
+					if conf.enableStatsJSON {
+						setLatestStats(interfaces[i], scraped)
+					}
 
-					// append to the slice held in metricsMap
-					// metricsMap[metricName] = append(metricsMap[metricName], metricVal)
-					metricsMap[metricName][i] = metricVal
+					updateMsgPerFlow(conf, body, hostname, interfaces[i])
+				}
 
-					hostname, err := os.Hostname()
-					if err != nil {
-						log.Println("oh no. Unable to detect what your hostname is :shrug:")
+				ntopng_scraped_interfaces.Set(float64(scrapedInterfaces))
+				ntopng_failed_interfaces.Set(float64(len(interfaces) - scrapedInterfaces))
+				if cycleSucceeded(scrapedInterfaces, len(interfaces), conf.minSuccessFraction) {
+					ntopng_last_successful_cycle.SetToCurrentTime()
+					exporterReady.Store(true)
+				} else {
+					errorLog.Printf("cycle_unsuccessful", "[cycle %s] Warning: only %d of %d interfaces were scraped successfully, below MIN_INTERFACE_SUCCESS_FRACTION (%g). Not marking the cycle successful", cycleID, scrapedInterfaces, len(interfaces), conf.minSuccessFraction)
+				}
+
+				if len(conf.timeseries) > 0 {
+					for i := 0; i < len(interfaces); i++ {
+						scrapeTimeseries(conf, hostname, interfaces[i])
+					}
+				}
+
+				if conf.enableHostMetrics {
+					for i := 0; i < len(interfaces); i++ {
+						scrapeHosts(conf, hostname, interfaces[i])
 					}
+				}
 
-					// now update our metrics:
-					switch metricName {
-					case "zmq_msg_rcvd":
-						nettel_zmq_rcvd_messages.WithLabelValues(hostname, fmt.Sprintf("%d", interfaces[i])).Add(float64(toAdd))
-					case "dropped_flows":
-						nettel_flow_drops.WithLabelValues(hostname, fmt.Sprintf("%d", interfaces[i])).Add(float64(toAdd))
-					case "zmq_msg_drops":
-						nettel_zmq_msg_drops.WithLabelValues(hostname, fmt.Sprintf("%d", interfaces[i])).Add(float64(toAdd))
-					case "zmq_avg_msg_flows":
-						nettel_zmq_avg_msg_perflow.WithLabelValues(hostname, fmt.Sprintf("%d", interfaces[i])).Add(float64(toAdd))
-					default:
-						log.Println("Error: Invalid data! :(")
+				if conf.enableAlertMetrics {
+					for i := 0; i < len(interfaces); i++ {
+						scrapeAlerts(conf, hostname, interfaces[i])
 					}
 				}
+			}()
+
+			elapsed := time.Since(cycleStart)
+			if elapsed > scrapeInterval {
+				errorLog.Printf("cycle_overrun", "[cycle %s] Warning: scrape cycle took %s, longer than the %s scrape interval. Skipping missed ticks", cycleID, elapsed.Round(time.Millisecond), scrapeInterval)
+				ntopng_scrape_overruns.Inc()
+			}
+
+			// a single slow cycle is only an overrun; an average above the
+			// interval means the exporter can never keep up
+			if avgCycleDuration == 0 {
+				avgCycleDuration = elapsed
+			} else {
+				avgCycleDuration = time.Duration(cycleDurationAlpha*float64(elapsed) + (1-cycleDurationAlpha)*float64(avgCycleDuration))
 			}
+			ntopng_scrape_cycle_duration_avg.Set(avgCycleDuration.Seconds())
+			if avgCycleDuration > scrapeInterval && time.Since(lastSlowCycleWarning) > slowCycleWarningInterval {
+				errorLog.Printf("cycle_slow", "Warning: scrape cycles take %s on average, longer than the %s scrape interval. The exporter cannot keep up with ntopng", avgCycleDuration.Round(time.Millisecond), scrapeInterval)
+				lastSlowCycleWarning = time.Now()
+			}
+
+			pushMetrics()
 
+			if conf.runOnce {
+				return
+			}
 		}
 	}
 }
 
 func main() {
+	printConfig := flag.Bool("print-config", false, "print the resolved configuration as JSON (credentials redacted) and exit")
+	once := flag.Bool("once", false, "scrape ntopng once, print the metrics in the Prometheus text format and exit. Same as RUN_ONCE=true")
+	discover := flag.Bool("discover", false, "print the numeric fields in one interface's data.lua response with their current values and exit")
+	flag.Parse()
+
+	if flag.Arg(0) == "healthcheck" {
+		// keep the config logging out of the container runtime's health log
+		log.SetOutput(io.Discard)
+		os.Exit(runHealthcheck(parseConf()))
+	}
+
 	pid := os.Getpid()
 	log.Printf("The PID of this process is: %d\n", pid)
+	ntopng_exporter_start_time.SetToCurrentTime()
 
 	// conf is a struct with our configuration options in it
 	conf := parseConf()
+	if *once {
+		conf.runOnce = true
+	}
+
+	if *printConfig {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(conf); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	// everything registered through registerer carries STATIC_LABELS
+	registerer := prometheus.WrapRegistererWith(conf.staticLabels, registry)
+	registerMetrics(registerer, conf)
+
+	ntopngHTTPClient = newNtopngHTTPClient(conf)
+	ntopngBreaker = newCircuitBreaker(conf.breakerFailureThreshold, conf.breakerCooldown)
+	errorLog = newLogSampler(conf.logSampleInterval)
+	ntopngAttemptTimeout = conf.attemptTimeout
+	if conf.authMode == authModeCookie {
+		ntopngAuth = newNtopngSession(conf)
+	}
+	if conf.pushgatewayURL != nil {
+		metricsPusher = newMetricsPusher(conf, registry)
+	}
+	if conf.maxRequestsPerSecond > 0 {
+		// allow a burst of at least one request so a fractional rate still works
+		ntopngLimiter = rate.NewLimiter(rate.Limit(conf.maxRequestsPerSecond), int(math.Max(1, conf.maxRequestsPerSecond)))
+	}
+
+	if *discover {
+		if err := discoverFields(conf, os.Stdout); err != nil {
+			log.Fatalf("Unable to discover ntopng fields: %v", err)
+		}
+		return
+	}
+
+	if conf.runOnce {
+		if err := runOnce(conf, registry, registerer, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// fire up the prom exporter in a goroutine since it blocks
-	go promExport(conf.promPort, conf.promEndpoint)
+	var server *http.Server
+	if !conf.disableMetricsServer {
+		server = newMetricsServer(conf, registry)
+		go promExport(server, conf)
+	}
 
 	// Create a channel to receive signals.
 	sigChan := make(chan os.Signal, 1)
 
-	// Notify the channel for SIGINT and SIGTERM signals.
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	// Notify the channel for SIGINT and SIGTERM signals, and SIGUSR1 to drain.
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
 
 	// Create a context that can be cancelled.
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// Start a goroutine to perform work.
-	go scraper(ctx, "Task", conf)
+	var wg sync.WaitGroup
+	if conf.collectionMode != collectionModePoll {
+		go startOnDemandCollector(conf, registerer)
+		if metricsPusher != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pushPeriodically(ctx)
+			}()
+		}
+	} else {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			scraper(ctx, "Task", conf, &ntopngAPIClient{conf: conf})
+		}()
+	}
 
 	// Block until a signal is received.
 	sig := <-sigChan
 	fmt.Println("Received signal:", sig)
 
+	// SIGUSR1 drains before shutting down: /readyz turns not ready so load
+	// balancers stop sending us scrapes, while we keep scraping and serving
+	// /metrics for DRAIN_GRACE_SECONDS. Another signal cuts the drain short.
+	if sig == syscall.SIGUSR1 {
+		exporterDraining.Store(true)
+		log.Printf("Draining. /readyz reports not ready; shutting down in %s", conf.drainGrace)
+		select {
+		case <-time.After(conf.drainGrace):
+		case sig = <-sigChan:
+			fmt.Println("Received signal:", sig)
+		}
+	}
+
 	// Cancel the context to signal goroutines to stop.
 	cancel()
 
-	// Wait for goroutines to finish (optional).
-	time.Sleep(2 * time.Second)
+	// give the metrics server and the scraper SHUTDOWN_TIMEOUT_SECONDS between
+	// them to wind down, then give up on them so a stuck goroutine can't hang
+	// the process
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), conf.shutdownTimeout)
+	defer shutdownCancel()
+
+	if server != nil {
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Println("Error shutting down metrics server:", err)
+		}
+	}
+
+	scraperDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(scraperDone)
+	}()
+
+	select {
+	case <-scraperDone:
+	case <-shutdownCtx.Done():
+		log.Printf("Scraper did not stop within SHUTDOWN_TIMEOUT_SECONDS (%s). Forcing exit.", conf.shutdownTimeout)
+		os.Exit(1)
+	}
 
 	fmt.Println("Exiting...")
 
@@ -0,0 +1,833 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// readFixture returns the contents of testdata/name
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// newTestConfig returns a poll mode config pointed at ntopngURL, with the
+// defaults parseConf would pick. The exporter's metrics are registered with a
+// fresh registry, so each test starts from zeroed zmq metrics, and the shared
+// ntopng HTTP client is set up for the config.
+func newTestConfig(t *testing.T, ntopngURL string) (config, *prometheus.Registry) {
+	t.Helper()
+
+	parsed, err := url.Parse(ntopngURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := config{
+		ntopngURL:               parsed,
+		apiBasePath:             "/lua/rest/v2",
+		userAgent:               "ntopng-prom-exporter/test",
+		statsBasePath:           "rsp.zmqRecvStats",
+		msgPerFlowMessagesField: "zmq_msg_rcvd",
+		msgPerFlowFlowsField:    "flows",
+		minSuccessFraction:      1,
+		disabledMetrics:         map[string]bool{},
+		maxResponseBytes:        8 * 1024 * 1024,
+		collectionMode:          collectionModePoll,
+	}
+
+	registry := prometheus.NewRegistry()
+	registerMetrics(registry, conf)
+	ntopngHTTPClient = newNtopngHTTPClient(conf)
+	ntopng_counter_resets.Reset()
+	ntopng_scrape_errors.Reset()
+
+	return conf, registry
+}
+
+// newFakeNtopng starts a server answering in ntopng's place with handler and
+// returns a config pointed at it
+func newFakeNtopng(t *testing.T, handler http.Handler) (config, *prometheus.Registry) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return newTestConfig(t, server.URL)
+}
+
+// serveFixture answers with testdata/name as JSON
+func serveFixture(t *testing.T, w http.ResponseWriter, name string) {
+	t.Helper()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(readFixture(t, name)))
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("EXPAND_ENV_TEST_SITE", "pop1")
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "no references", value: "flows received", want: "flows received"},
+		{name: "braced reference", value: "flows at ${EXPAND_ENV_TEST_SITE}", want: "flows at pop1"},
+		{name: "plain dollar", value: "billed at $5", want: "billed at $5"},
+		{name: "bare variable name is not expanded", value: "$EXPAND_ENV_TEST_SITE", want: "$EXPAND_ENV_TEST_SITE"},
+		{name: "trailing dollar", value: "cost in $", want: "cost in $"},
+		{name: "escaped dollar", value: "literal $${EXPAND_ENV_TEST_SITE}", want: "literal ${EXPAND_ENV_TEST_SITE}"},
+		{name: "unset variable", value: "${EXPAND_ENV_TEST_UNSET}", wantErr: true},
+		{name: "unterminated reference", value: "${EXPAND_ENV_TEST_SITE", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandEnv(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expandEnv(%q) = %q, want an error", tt.value, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expandEnv(%q) returned %v", tt.value, err)
+			}
+			if got != tt.want {
+				t.Errorf("expandEnv(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupStatNestedCounters(t *testing.T) {
+	body := readFixture(t, "data_nested_counters.json")
+	basePath := "rsp.zmqRecvStats"
+
+	tests := []struct {
+		field      string
+		wantExists bool
+		want       float64
+		wantPath   string
+	}{
+		{field: "zmq_msg_rcvd", wantExists: true, want: 32300, wantPath: "rsp.zmqRecvStats.zmq_msg_rcvd"},
+		// found under counters without being told
+		{field: "dropped_flows", wantExists: true, want: 17, wantPath: "rsp.zmqRecvStats.counters.dropped_flows"},
+		// dotted fields reach into nested objects
+		{field: "counters.zmq_msg_drops", wantExists: true, want: 2, wantPath: "rsp.zmqRecvStats.counters.zmq_msg_drops"},
+		{field: "counters.tlv.msgs", wantExists: true, want: 41, wantPath: "rsp.zmqRecvStats.counters.tlv.msgs"},
+		// a missing field reports the path it was expected at
+		{field: "zmq_avg_msg_flows", wantExists: false, wantPath: "rsp.zmqRecvStats.zmq_avg_msg_flows"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			val, path := lookupStat(body, basePath, tt.field)
+			if val.Exists() != tt.wantExists {
+				t.Fatalf("lookupStat(%q) exists = %v, want %v", tt.field, val.Exists(), tt.wantExists)
+			}
+			if tt.wantExists && val.Float() != tt.want {
+				t.Errorf("lookupStat(%q) = %v, want %v", tt.field, val.Float(), tt.want)
+			}
+			if path != tt.wantPath {
+				t.Errorf("lookupStat(%q) path = %q, want %q", tt.field, path, tt.wantPath)
+			}
+		})
+	}
+}
+
+func TestReadMetricMappingsField(t *testing.T) {
+	tests := []struct {
+		name      string
+		mapping   string
+		wantField string
+		wantErr   bool
+	}{
+		{name: "unset", mapping: `{"zmq_msg_drops": {}}`, wantField: "zmq_msg_drops"},
+		{name: "nested", mapping: `{"zmq_msg_drops": {"field": "counters.zmq_msg_drops"}}`, wantField: "counters.zmq_msg_drops"},
+		{name: "escaped metacharacter", mapping: `{"zmq_msg_drops": {"field": "counters.drops\\#1"}}`, wantField: `counters.drops\#1`},
+		{name: "leading dot", mapping: `{"zmq_msg_drops": {"field": ".zmq_msg_drops"}}`, wantErr: true},
+		{name: "trailing dot", mapping: `{"zmq_msg_drops": {"field": "counters."}}`, wantErr: true},
+		{name: "empty key", mapping: `{"zmq_msg_drops": {"field": "counters..drops"}}`, wantErr: true},
+		{name: "wildcard", mapping: `{"zmq_msg_drops": {"field": "counters.*"}}`, wantErr: true},
+		{name: "query", mapping: `{"zmq_msg_drops": {"field": "counters.#"}}`, wantErr: true},
+		{name: "trailing backslash", mapping: `{"zmq_msg_drops": {"field": "counters\\"}}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mapping.json")
+			err := os.WriteFile(path, []byte(tt.mapping), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mappings, err := readMetricMappings(path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readMetricMappings(%s) succeeded, want an error", tt.mapping)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readMetricMappings(%s) returned %v", tt.mapping, err)
+			}
+
+			conf := config{metricMappings: mappings}
+			if got := metricField(conf, "zmq_msg_drops"); got != tt.wantField {
+				t.Errorf("metricField = %q, want %q", got, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestNtopngHTTPClientProxy(t *testing.T) {
+	// the proxy answers in ntopng's place, so a request only succeeds if it was
+	// sent through the proxy. ntopng.invalid can't be resolved.
+	var proxied atomic.Int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "ntopng.invalid" {
+			proxied.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"rc":0,"rsp":[]}`))
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := newNtopngHTTPClient(config{httpProxy: proxyURL})
+	resp, err := client.Get("http://ntopng.invalid/lua/rest/v2/get/ntopng/interfaces.lua")
+	if err != nil {
+		t.Fatalf("request through NTOPNG_HTTP_PROXY failed: %v", err)
+	}
+	resp.Body.Close()
+	if n := proxied.Load(); n != 1 {
+		t.Errorf("proxy saw %d requests for ntopng, want 1", n)
+	}
+
+	// without NTOPNG_HTTP_PROXY the transport defers to HTTP_PROXY, HTTPS_PROXY
+	// and NO_PROXY. net/http reads those once per process, so check that the
+	// transport uses http.ProxyFromEnvironment rather than sending a request.
+	transport := newNtopngHTTPClient(config{}).Transport.(*http.Transport)
+	if transport.Proxy == nil || reflect.ValueOf(transport.Proxy).Pointer() != reflect.ValueOf(http.ProxyFromEnvironment).Pointer() {
+		t.Error("transport doesn't use http.ProxyFromEnvironment when NTOPNG_HTTP_PROXY is unset")
+	}
+}
+
+func TestEnumerateInterfacesPagination(t *testing.T) {
+	tests := []struct {
+		name string
+		// pages maps the currentPage parameter to the fixture served for it
+		pages      map[string]string
+		want       []int
+		wantNames  map[int]string
+		wantPaging []string
+	}{
+		{
+			name:       "single response",
+			pages:      map[string]string{"": "interfaces.json"},
+			want:       []int{0, 1},
+			wantNames:  map[int]string{0: "eth0", 1: "eth1"},
+			wantPaging: []string{""},
+		},
+		{
+			name:       "two pages",
+			pages:      map[string]string{"": "interfaces_page1.json", "2": "interfaces_page2.json"},
+			want:       []int{0, 1, 4},
+			wantNames:  map[int]string{0: "eth0", 1: "eth1", 4: "tcp://collector:5556"},
+			wantPaging: []string{"", "2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested []string
+			conf, _ := newFakeNtopng(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/lua/rest/v2/get/ntopng/interfaces.lua" {
+					http.NotFound(w, r)
+					return
+				}
+				page := r.URL.Query().Get("currentPage")
+				requested = append(requested, page)
+				fixture, ok := tt.pages[page]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				serveFixture(t, w, fixture)
+			}))
+
+			got, err := enumerateInterfaceIDsWithRetries(conf)
+			if err != nil {
+				t.Fatalf("enumerateInterfaceIDsWithRetries returned %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("enumerateInterfaceIDsWithRetries = %v, want %v", got, tt.want)
+			}
+			for ifid, want := range tt.wantNames {
+				if name := interfaceName(ifid); name != want {
+					t.Errorf("interfaceName(%d) = %q, want %q", ifid, name, want)
+				}
+			}
+			if !slices.Equal(requested, tt.wantPaging) {
+				t.Errorf("requested pages %q, want %q", requested, tt.wantPaging)
+			}
+		})
+	}
+}
+
+// fakeRetryClock replaces retrySleep and retryNow for the duration of the test
+// with a clock that only moves when the retry loop sleeps. It returns the
+// delays the loop asked for.
+func fakeRetryClock(t *testing.T) *[]time.Duration {
+	t.Helper()
+
+	var slept []time.Duration
+	now := time.Unix(0, 0)
+
+	sleep, clock := retrySleep, retryNow
+	retrySleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+	retryNow = func() time.Time { return now }
+	t.Cleanup(func() { retrySleep, retryNow = sleep, clock })
+
+	return &slept
+}
+
+func TestQueryNtopMetricsBackoff(t *testing.T) {
+	// the full schedule when every attempt fails: 1.2^n seconds, truncated
+	var fullSchedule []time.Duration
+	for n := 1; n <= maxRetries; n++ {
+		fullSchedule = append(fullSchedule, time.Duration(int(math.Pow(1.2, float64(n))))*time.Second)
+	}
+
+	tests := []struct {
+		name string
+		// status answers the given attempt, counting from 1
+		status        func(attempt int) int
+		retryDeadline time.Duration
+		wantAttempts  int
+		wantSlept     []time.Duration
+		wantErr       bool
+	}{
+		{
+			name:         "gives up after maxRetries",
+			status:       func(int) int { return http.StatusBadGateway },
+			wantAttempts: maxRetries,
+			wantSlept:    fullSchedule,
+			wantErr:      true,
+		},
+		{
+			name: "recovers",
+			status: func(attempt int) int {
+				if attempt < 3 {
+					return http.StatusServiceUnavailable
+				}
+				return http.StatusOK
+			},
+			wantAttempts: 3,
+			wantSlept:    []time.Duration{time.Second, time.Second},
+		},
+		{
+			name:         "auth failures aren't retried",
+			status:       func(int) int { return http.StatusUnauthorized },
+			wantAttempts: 1,
+			wantErr:      true,
+		},
+		{
+			// the last backoff is trimmed to what is left of the deadline
+			name:          "stops at the retry deadline",
+			status:        func(int) int { return http.StatusInternalServerError },
+			retryDeadline: 10 * time.Second,
+			wantAttempts:  8,
+			wantSlept:     []time.Duration{time.Second, time.Second, time.Second, 2 * time.Second, 2 * time.Second, 2 * time.Second, time.Second},
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+			conf, _ := newFakeNtopng(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempts += 1
+				if status := tt.status(attempts); status != http.StatusOK {
+					w.WriteHeader(status)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(zmqStatsBody(100, 10, 1, 3)))
+			}))
+			conf.retryDeadline = tt.retryDeadline
+			slept := fakeRetryClock(t)
+
+			_, err := queryNtopMetrics(conf, 0)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("queryNtopMetrics returned %v, want an error: %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("ntopng saw %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if !slices.Equal(*slept, tt.wantSlept) {
+				t.Errorf("slept %v, want %v", *slept, tt.wantSlept)
+			}
+		})
+	}
+}
+
+func TestSanitizeIfname(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "eth0", want: "eth0"},
+		{name: "view:all", want: "view_all"},
+		{name: "eth0 (mirror)", want: "eth0_mirror_"},
+		{name: "tcp://127.0.0.1:5556", want: "tcp_127_0_0_1_5556"},
+		{name: "bond0 : uplink", want: "bond0_uplink"},
+		{name: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeIfname(tt.name); got != tt.want {
+				t.Errorf("sanitizeIfname(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	// the interface's state carries both forms
+	setInterfaceNames(map[int]string{7: "eth0 (mirror)"})
+	t.Cleanup(func() { setInterfaceNames(map[int]string{}) })
+	setInterfaceUp(7, true)
+	if got := testutil.ToFloat64(ntopng_interface_up.WithLabelValues("7", "eth0_mirror_", "eth0 (mirror)")); got != 1 {
+		t.Errorf("ntopng_interface_up{ifname=\"eth0_mirror_\",ifname_raw=\"eth0 (mirror)\"} = %v, want 1", got)
+	}
+}
+
+func TestJoinHostPortURLIPv6(t *testing.T) {
+	tests := []struct {
+		rawURL string
+		port   string
+		want   string
+	}{
+		{rawURL: "http://[::1]", port: "3000", want: "http://[::1]:3000"},
+		{rawURL: "http://[::1]:3000", port: "", want: "http://[::1]:3000"},
+		{rawURL: "http://[::1]", port: "", want: "http://[::1]:3000"},
+		{rawURL: "https://[2001:db8::10]/ntopng", port: "3443", want: "https://[2001:db8::10]:3443/ntopng"},
+		{rawURL: "http://[fe80::1%25eth0]", port: "3000", want: "http://[fe80::1%25eth0]:3000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rawURL+" "+tt.port, func(t *testing.T) {
+			got, err := joinHostPortURL(tt.rawURL, tt.port)
+			if err != nil {
+				t.Fatalf("joinHostPortURL(%q, %q) returned %v", tt.rawURL, tt.port, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("joinHostPortURL(%q, %q) = %q, want %q", tt.rawURL, tt.port, got, tt.want)
+			}
+		})
+	}
+
+	u, err := joinHostPortURL("http://[::1]", "3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := config{ntopngURL: u, apiBasePath: "/lua/rest/v2"}
+	want := "http://[::1]:3000/lua/rest/v2/get/interface/data.lua?ifid=0"
+	if got := ntopngAPIURL(conf, "/get/interface/data.lua", url.Values{"ifid": {"0"}}); got != want {
+		t.Errorf("ntopngAPIURL = %q, want %q", got, want)
+	}
+}
+
+// parseTestConf runs parseConf with the ntopng address settings in env. Those
+// not in env are unset for the duration of the test.
+func parseTestConf(t *testing.T, env map[string]string) config {
+	t.Helper()
+
+	for _, name := range []string{"NTOPNG_API_URL", "NTOPNG_API_PORT", "NTOPNG_API_BASE_PATH"} {
+		value, ok := env[name]
+		t.Setenv(name, value)
+		if !ok {
+			os.Unsetenv(name)
+		}
+	}
+
+	return parseConf()
+}
+
+func TestParseConfTrailingSlash(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{name: "no slash", url: "http://ntop", want: "http://ntop:3000/lua/rest/v2/get/interface/data.lua?ifid=0"},
+		{name: "slash", url: "http://ntop/", want: "http://ntop:3000/lua/rest/v2/get/interface/data.lua?ifid=0"},
+		{name: "slashes", url: "http://ntop//", want: "http://ntop:3000/lua/rest/v2/get/interface/data.lua?ifid=0"},
+		{name: "port and no slash", url: "http://ntop:3000", want: "http://ntop:3000/lua/rest/v2/get/interface/data.lua?ifid=0"},
+		{name: "port and slash", url: "http://ntop:3000/", want: "http://ntop:3000/lua/rest/v2/get/interface/data.lua?ifid=0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := parseTestConf(t, map[string]string{"NTOPNG_API_URL": tt.url})
+			got := ntopngAPIURL(conf, "/get/interface/data.lua", url.Values{"ifid": {"0"}})
+			if got != tt.want {
+				t.Errorf("NTOPNG_API_URL=%s requests %q, want %q", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnumerateInterfacesExcludesViewAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+	}{
+		{name: "plain list", fixture: "interfaces_view_all.json"},
+		{name: "paginated", fixture: "interfaces_view_all_paged.json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, _ := newFakeNtopng(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serveFixture(t, w, tt.fixture)
+			}))
+
+			// summing across view:all and the interfaces it aggregates would
+			// double-count every flow
+			got, err := enumerateInterfaceIDsWithRetries(conf)
+			if err != nil {
+				t.Fatalf("enumerateInterfaceIDsWithRetries returned %v", err)
+			}
+			if want := []int{0, 1}; !slices.Equal(got, want) {
+				t.Errorf("enumerateInterfaceIDsWithRetries = %v, want %v", got, want)
+			}
+			if name := interfaceName(2); name != "" {
+				t.Errorf("interfaceName(2) = %q, want view:all to be left out", name)
+			}
+		})
+	}
+}
+
+// gzipFixture returns testdata/name gzipped
+func gzipFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(readFixture(t, name)))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGzipResponses(t *testing.T) {
+	compressed := gzipFixture(t, "data.json")
+
+	tests := []struct {
+		name string
+		// gzipUnasked compresses the response even when the request didn't ask
+		// for gzip, as a misbehaving proxy might
+		gzipUnasked bool
+		// acceptEncoding is set on the request, which stops the transport from
+		// decompressing for us
+		acceptEncoding string
+	}{
+		{name: "transport asks and decompresses"},
+		{name: "compressed without being asked", gzipUnasked: true, acceptEncoding: "identity"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, _ := newFakeNtopng(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if tt.gzipUnasked || strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+					w.Header().Set("Content-Encoding", "gzip")
+					w.Write(compressed)
+					return
+				}
+				w.Write([]byte(readFixture(t, "data.json")))
+			}))
+
+			req, err := http.NewRequest("GET", ntopngAPIURL(conf, "/get/interface/data.lua", url.Values{"ifid": {"0"}}), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+
+			resp, err := doNtopRequest(req, endpointInterfaceData)
+			if err != nil {
+				t.Fatalf("doNtopRequest returned %v", err)
+			}
+			defer resp.Body.Close()
+
+			body, err := readResponseBody(resp, conf.maxResponseBytes, endpointInterfaceData)
+			if err != nil {
+				t.Fatalf("readResponseBody returned %v", err)
+			}
+			val, _ := lookupStat(string(body), conf.statsBasePath, "zmq_msg_rcvd")
+			if val.Int() != 32300 {
+				t.Errorf("zmq_msg_rcvd = %v, want 32300 from the decompressed fixture", val)
+			}
+		})
+	}
+}
+
+func TestEndToEnd(t *testing.T) {
+	conf, registry := newFakeNtopng(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/lua/rest/v2/get/ntopng/interfaces.lua":
+			serveFixture(t, w, "interfaces.json")
+		case "/lua/rest/v2/get/interface/data.lua":
+			switch r.URL.Query().Get("ifid") {
+			case "0":
+				serveFixture(t, w, "data.json")
+			case "1":
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(zmqStatsBody(500, 5, 1, 4)))
+			default:
+				http.NotFound(w, r)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	conf.promEndpoint = "/metrics"
+	fastScrapeInterval(t)
+
+	exporter := httptest.NewServer(newMetricsServer(conf, registry).Handler)
+	defer exporter.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		scraper(ctx, "Test", conf, &ntopngAPIClient{conf: conf})
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+
+	hostname, _ := os.Hostname()
+	expected := fmt.Sprintf(`# HELP nettel_zmq_rcvd_messages %[2]s
+# TYPE nettel_zmq_rcvd_messages counter
+nettel_zmq_rcvd_messages{hostname=%[1]q,ifid="0"} 32300
+nettel_zmq_rcvd_messages{hostname=%[1]q,ifid="1"} 500
+# HELP nettel_flow_drops %[3]s
+# TYPE nettel_flow_drops counter
+nettel_flow_drops{hostname=%[1]q,ifid="0"} 17
+nettel_flow_drops{hostname=%[1]q,ifid="1"} 5
+# HELP nettel_zmq_msg_drops %[4]s
+# TYPE nettel_zmq_msg_drops counter
+nettel_zmq_msg_drops{hostname=%[1]q,ifid="0"} 2
+nettel_zmq_msg_drops{hostname=%[1]q,ifid="1"} 1
+# HELP nettel_zmq_avg_msg_perflows %[5]s
+# TYPE nettel_zmq_avg_msg_perflows gauge
+nettel_zmq_avg_msg_perflows{hostname=%[1]q,ifid="0"} 3
+nettel_zmq_avg_msg_perflows{hostname=%[1]q,ifid="1"} 4
+`, hostname, metricHelp(conf, "zmq_msg_rcvd"), metricHelp(conf, "dropped_flows"), metricHelp(conf, "zmq_msg_drops"), metricHelp(conf, "zmq_avg_msg_flows"))
+	metricNames := []string{"nettel_zmq_rcvd_messages", "nettel_flow_drops", "nettel_zmq_msg_drops", "nettel_zmq_avg_msg_perflows"}
+
+	// the first cycles may still be in flight, so scrape until the exporter
+	// has caught up
+	timeout := time.After(10 * time.Second)
+	for {
+		err := testutil.ScrapeAndCompare(exporter.URL+"/metrics", strings.NewReader(expected), metricNames...)
+		if err == nil {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("/metrics never matched: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestJoinHostPortURLPort(t *testing.T) {
+	tests := []struct {
+		name    string
+		rawURL  string
+		port    string
+		want    string
+		wantErr bool
+	}{
+		{name: "port in URL", rawURL: "http://ntop:3000", want: "http://ntop:3000"},
+		{name: "port in NTOPNG_API_PORT", rawURL: "http://ntop", port: "3001", want: "http://ntop:3001"},
+		{name: "neither", rawURL: "http://ntop", want: "http://ntop:" + defaultNtopngPort},
+		// a reverse proxy in front of ntopng listens on the scheme's port
+		{name: "neither, https", rawURL: "https://ntop", want: "https://ntop"},
+		{name: "neither, path", rawURL: "http://gateway/ntopng", want: "http://gateway/ntopng"},
+		{name: "both the same", rawURL: "http://ntop:3001", port: "3001", want: "http://ntop:3001"},
+		{name: "both different", rawURL: "http://ntop:3000", port: "3001", wantErr: true},
+		{name: "no host", rawURL: "ntop", port: "3000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := joinHostPortURL(tt.rawURL, tt.port)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("joinHostPortURL(%q, %q) = %q, want an error", tt.rawURL, tt.port, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("joinHostPortURL(%q, %q) returned %v", tt.rawURL, tt.port, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("joinHostPortURL(%q, %q) = %q, want %q", tt.rawURL, tt.port, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConfSubpath(t *testing.T) {
+	tests := []struct {
+		name      string
+		env       map[string]string
+		want      string
+		wantLogin string
+	}{
+		{
+			name:      "subpath",
+			env:       map[string]string{"NTOPNG_API_URL": "https://gateway:8443/ntopng/"},
+			want:      "https://gateway:8443/ntopng/lua/rest/v2/get/interface/data.lua?ifid=0",
+			wantLogin: "https://gateway:8443/ntopng/authorize.html",
+		},
+		{
+			name:      "subpath without trailing slash",
+			env:       map[string]string{"NTOPNG_API_URL": "https://gateway:8443/ntopng"},
+			want:      "https://gateway:8443/ntopng/lua/rest/v2/get/interface/data.lua?ifid=0",
+			wantLogin: "https://gateway:8443/ntopng/authorize.html",
+		},
+		{
+			name:      "nested subpath",
+			env:       map[string]string{"NTOPNG_API_URL": "https://gateway:8443/tools/ntopng/"},
+			want:      "https://gateway:8443/tools/ntopng/lua/rest/v2/get/interface/data.lua?ifid=0",
+			wantLogin: "https://gateway:8443/tools/ntopng/authorize.html",
+		},
+		{
+			name:      "subpath and base path",
+			env:       map[string]string{"NTOPNG_API_URL": "https://gateway:8443/ntopng/", "NTOPNG_API_BASE_PATH": "/api/v2/"},
+			want:      "https://gateway:8443/ntopng/api/v2/get/interface/data.lua?ifid=0",
+			wantLogin: "https://gateway:8443/ntopng/authorize.html",
+		},
+		{
+			// the proxy is on https's own port, not ntopng's
+			name:      "https subpath without port",
+			env:       map[string]string{"NTOPNG_API_URL": "https://gateway/ntopng/"},
+			want:      "https://gateway/ntopng/lua/rest/v2/get/interface/data.lua?ifid=0",
+			wantLogin: "https://gateway/ntopng/authorize.html",
+		},
+		{
+			name:      "http subpath without port",
+			env:       map[string]string{"NTOPNG_API_URL": "http://gateway/ntopng"},
+			want:      "http://gateway/ntopng/lua/rest/v2/get/interface/data.lua?ifid=0",
+			wantLogin: "http://gateway/ntopng/authorize.html",
+		},
+		{
+			name:      "subpath and NTOPNG_API_PORT",
+			env:       map[string]string{"NTOPNG_API_URL": "https://gateway/ntopng/", "NTOPNG_API_PORT": "8443"},
+			want:      "https://gateway:8443/ntopng/lua/rest/v2/get/interface/data.lua?ifid=0",
+			wantLogin: "https://gateway:8443/ntopng/authorize.html",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := parseTestConf(t, tt.env)
+			if got := ntopngAPIURL(conf, "/get/interface/data.lua", url.Values{"ifid": {"0"}}); got != tt.want {
+				t.Errorf("requests %q, want %q", got, tt.want)
+			}
+			if got := newNtopngSession(conf).loginURL; got != tt.wantLogin {
+				t.Errorf("logs in at %q, want %q", got, tt.wantLogin)
+			}
+		})
+	}
+}
+
+func TestParseStaticLabelsReserved(t *testing.T) {
+	// instance and job would clash with the Pushgateway grouping and with the
+	// labels Prometheus sets on the target
+	for _, value := range []string{"instance=ntop1", "job=ntopng", "region=us-east,ifid=1"} {
+		if _, err := parseStaticLabels(value); err == nil {
+			t.Errorf("parseStaticLabels(%q) accepted a reserved label", value)
+		}
+	}
+
+	got, err := parseStaticLabels("region=us-east, env=prod")
+	if err != nil {
+		t.Fatalf("parseStaticLabels returned %v", err)
+	}
+	if want := (prometheus.Labels{"region": "us-east", "env": "prod"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseStaticLabels = %v, want %v", got, want)
+	}
+}
+
+func TestCircuitBreakerLateRequestKeepsProbe(t *testing.T) {
+	b := newCircuitBreaker(1, time.Millisecond)
+
+	// a request goes out while the breaker is closed, and another one fails
+	// and opens it
+	late, err := b.allow()
+	if err != nil {
+		t.Fatalf("closed breaker refused a request: %v", err)
+	}
+	failed, _ := b.allow()
+	b.record(failed, errors.New("connection refused"))
+
+	time.Sleep(2 * time.Millisecond)
+	probe, err := b.allow()
+	if err != nil {
+		t.Fatalf("breaker refused the probe after its cooldown: %v", err)
+	}
+
+	// the slow request coming back doesn't end the probe, so nothing else may
+	// go out until the probe reports back
+	b.record(late, nil)
+	if _, err := b.allow(); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("a second request was let through while the probe was in flight: %v", err)
+	}
+
+	b.record(probe, nil)
+	if b.state != breakerClosed {
+		t.Errorf("breaker is %s after the probe succeeded, want closed", b.state)
+	}
+}
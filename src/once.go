@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runOnce collects a single round of metrics and writes everything in the
+// registry to out in the Prometheus text format. It backs --once/RUN_ONCE,
+// for cron jobs and pipelines that want the metrics without a long-running
+// exporter.
+//
+// Enumeration retries on its own for a long time, so the collection is
+// bounded by RUN_ONCE_TIMEOUT_SECONDS. An error is returned if it doesn't
+// finish in time, or if too few interfaces were scraped for the round to count
+// as successful; the metrics are still written in the latter case.
+func runOnce(conf config, registry *prometheus.Registry, registerer prometheus.Registerer, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), conf.runOnceTimeout)
+	defer cancel()
+
+	var collector *ntopngCollector
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		if conf.collectionMode == collectionModePoll {
+			// conf.runOnce makes the scraper return after its first cycle
+			scraper(ctx, "Task", conf, &ntopngAPIClient{conf: conf})
+		} else {
+			// the collector queries ntopng when we gather below
+			collector = startOnDemandCollector(conf, registerer)
+		}
+	}()
+
+	select {
+	case <-collected:
+	case <-ctx.Done():
+		return fmt.Errorf("ntopng could not be scraped within RUN_ONCE_TIMEOUT_SECONDS (%s)", conf.runOnceTimeout)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics: %w", err)
+	}
+
+	encoder := expfmt.NewEncoder(out, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return fmt.Errorf("encoding %s: %w", family.GetName(), err)
+		}
+	}
+
+	// in poll mode exporterReady is only set by a successful cycle
+	succeeded := exporterReady.Load()
+	if collector != nil {
+		succeeded = collector.lastSucceeded.Load()
+	}
+	if !succeeded {
+		return errors.New("too few ntopng interfaces were scraped successfully; see MIN_INTERFACE_SUCCESS_FRACTION")
+	}
+
+	return nil
+}
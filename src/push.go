@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+var (
+	ntopng_pushgateway_failures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntopng_pushgateway_failures_total",
+		Help: "Pushes to PUSHGATEWAY_URL that failed.",
+	})
+)
+
+// metricsPusher pushes the registry to PUSHGATEWAY_URL after every scrape
+// cycle. It is nil unless PUSHGATEWAY_URL is set. It is created in main() once
+// the config has been parsed.
+var metricsPusher *push.Pusher
+
+// newMetricsPusher returns a Pusher for c's Pushgateway that pushes everything
+// in gatherer. Pushes are grouped by job and the exporter's hostname so that
+// exporters on different hosts don't overwrite each other's metrics.
+func newMetricsPusher(c config, gatherer prometheus.Gatherer) *push.Pusher {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Println("oh no. Unable to detect what your hostname is :shrug:")
+	}
+
+	return push.New(c.pushgatewayURL.String(), c.pushgatewayJob).
+		Gatherer(gatherer).
+		Grouping("instance", hostname)
+}
+
+// pushMetrics replaces our group on the Pushgateway with the current metrics.
+// Failures are logged and counted; the next cycle simply pushes again.
+func pushMetrics() {
+	if metricsPusher == nil {
+		return
+	}
+
+	if err := metricsPusher.Push(); err != nil {
+		errorLog.Printf("pushgateway", "Error: Unable to push metrics to the Pushgateway: %v", err)
+		ntopng_pushgateway_failures.Inc()
+	}
+}
+
+// pushPeriodically pushes every scrapeInterval until ctx is cancelled. The
+// ondemand and passthrough modes have no scrape cycle of their own, so this
+// stands in for it; each push makes the collector query ntopng.
+func pushPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(scrapeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pushMetrics()
+		}
+	}
+}
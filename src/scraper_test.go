@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeNtopClient is an NtopClient serving canned responses instead of talking
+// to ntopng
+type fakeNtopClient struct {
+	mu sync.Mutex
+	// enumerations are returned by successive EnumerateInterfaceIDs calls. The
+	// last one repeats.
+	enumerations [][]int
+	enumerated   int
+	// responses are the data.lua bodies returned by successive queries for
+	// each ifid. The last one repeats.
+	responses map[int][]string
+	// queried lists the ifids queried, in order
+	queried []int
+}
+
+func (f *fakeNtopClient) EnumerateInterfaceIDs() ([]int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i := min(f.enumerated, len(f.enumerations)-1)
+	f.enumerated += 1
+	return f.enumerations[i], nil
+}
+
+func (f *fakeNtopClient) QueryInterfaceData(ifid int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var n int
+	for _, queried := range f.queried {
+		if queried == ifid {
+			n += 1
+		}
+	}
+	f.queried = append(f.queried, ifid)
+
+	responses, ok := f.responses[ifid]
+	if !ok {
+		return "", fmt.Errorf("no responses for interface %d", ifid)
+	}
+	return responses[min(n, len(responses)-1)], nil
+}
+
+// queries returns the ifids queried so far, in order
+func (f *fakeNtopClient) queries() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.queried...)
+}
+
+// zmqStatsBody returns a data.lua response reporting the given zmqRecvStats
+func zmqStatsBody(msgRcvd, droppedFlows, msgDrops, avgMsgFlows int) string {
+	return fmt.Sprintf(`{"rc":0,"rc_str":"OK","rsp":{"version":"6.2.0","zmqRecvStats":{"zmq_msg_rcvd":%d,"flows":100,"dropped_flows":%d,"zmq_msg_drops":%d,"zmq_avg_msg_flows":%d}}}`,
+		msgRcvd, droppedFlows, msgDrops, avgMsgFlows)
+}
+
+// newScraperTestConfig returns a config for running the scraper against a
+// fakeNtopClient, with cycles running back to back
+func newScraperTestConfig(t *testing.T) (config, *prometheus.Registry) {
+	t.Helper()
+
+	// nothing listens here. The scraper looks up the ntopng version outside
+	// of its NtopClient; that lookup fails and is only logged.
+	conf, registry := newTestConfig(t, "http://127.0.0.1:1")
+	fastScrapeInterval(t)
+
+	return conf, registry
+}
+
+// fastScrapeInterval runs scrape cycles back to back for the duration of the
+// test
+func fastScrapeInterval(t *testing.T) {
+	t.Helper()
+
+	interval := scrapeInterval
+	scrapeInterval = 5 * time.Millisecond
+	t.Cleanup(func() { scrapeInterval = interval })
+}
+
+// runScraper runs the scraper against client until done is true for the ifids
+// it has queried, then stops it and waits for it to return
+func runScraper(t *testing.T, conf config, client *fakeNtopClient, done func(queried []int) bool) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		scraper(ctx, "Test", conf, client)
+	}()
+
+	timeout := time.After(10 * time.Second)
+	for !done(client.queries()) {
+		select {
+		case <-timeout:
+			cancel()
+			<-stopped
+			t.Fatalf("scraper made only these queries before timing out: %v", client.queries())
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	cancel()
+	<-stopped
+}
+
+// queriedAtLeast is a done func for runScraper that waits for n queries
+func queriedAtLeast(n int) func([]int) bool {
+	return func(queried []int) bool {
+		return len(queried) >= n
+	}
+}
+
+// counterValue returns the value of metricName's counter for ifid
+func counterValue(t *testing.T, metricName string, ifid int) float64 {
+	t.Helper()
+
+	hostname, _ := os.Hostname()
+	counter := zmqMetrics[metricName].counter
+	if counter == nil {
+		t.Fatalf("%s is not exported as a counter", metricName)
+	}
+	return testutil.ToFloat64(counter.WithLabelValues(hostname, fmt.Sprintf("%d", ifid)))
+}
+
+func TestScraperSkipsMissingStats(t *testing.T) {
+	tests := []struct {
+		name string
+		// body is answered between two good responses
+		body string
+	}{
+		{name: "no zmqRecvStats", body: `{"rc":0,"rc_str":"OK","rsp":{"version":"6.2.0","ifid":0}}`},
+		{name: "empty zmqRecvStats", body: `{"rc":0,"rc_str":"OK","rsp":{"version":"6.2.0","zmqRecvStats":{}}}`},
+		{name: "no rsp", body: `{"rc":0,"rc_str":"OK"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, _ := newScraperTestConfig(t)
+			client := &fakeNtopClient{
+				enumerations: [][]int{{0}},
+				responses: map[int][]string{
+					0: {zmqStatsBody(1000, 100, 10, 3), tt.body, zmqStatsBody(1500, 150, 15, 3)},
+				},
+			}
+
+			runScraper(t, conf, client, queriedAtLeast(3))
+
+			// a missing field read as 0 would look like a reset, after which the
+			// whole of ntopng's next value would be added on top
+			for metricName, want := range map[string]float64{"zmq_msg_rcvd": 1500, "dropped_flows": 150, "zmq_msg_drops": 15} {
+				if got := counterValue(t, metricName, 0); got != want {
+					t.Errorf("%s = %v, want %v", metricName, got, want)
+				}
+				if resets := testutil.ToFloat64(ntopng_counter_resets.WithLabelValues(metricName, "0")); resets != 0 {
+					t.Errorf("%s counted %v resets, want 0", metricName, resets)
+				}
+			}
+			if errs := testutil.ToFloat64(ntopng_scrape_errors.WithLabelValues("0", "missing_field")); errs == 0 {
+				t.Error("the missing fields weren't counted in ntopng_scrape_errors_total")
+			}
+		})
+	}
+}
+
+func TestScraperInterfaceReordering(t *testing.T) {
+	conf, _ := newScraperTestConfig(t)
+	conf.enumerationInterval = time.Millisecond
+
+	// ntopng lists the same interfaces in a different order after the first
+	// enumeration. Their values never change, so no counter should move after
+	// the first cycle.
+	client := &fakeNtopClient{
+		enumerations: [][]int{{0, 1}, {1, 0}},
+		responses: map[int][]string{
+			0: {zmqStatsBody(1000, 100, 10, 3)},
+			1: {zmqStatsBody(10, 1, 0, 3)},
+		},
+	}
+
+	// every cycle queries both interfaces, so the queries pair up by cycle.
+	// Stop after two cycles in the new order.
+	reorderedCycles := func(queried []int) bool {
+		var n int
+		for i := 0; i+1 < len(queried); i += 2 {
+			if queried[i] == 1 && queried[i+1] == 0 {
+				n += 1
+			}
+		}
+		return n >= 2
+	}
+
+	runScraper(t, conf, client, reorderedCycles)
+
+	tests := []struct {
+		ifid   int
+		metric string
+		want   float64
+	}{
+		{ifid: 0, metric: "zmq_msg_rcvd", want: 1000},
+		{ifid: 0, metric: "dropped_flows", want: 100},
+		{ifid: 0, metric: "zmq_msg_drops", want: 10},
+		{ifid: 1, metric: "zmq_msg_rcvd", want: 10},
+		{ifid: 1, metric: "dropped_flows", want: 1},
+		{ifid: 1, metric: "zmq_msg_drops", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := counterValue(t, tt.metric, tt.ifid); got != tt.want {
+			t.Errorf("%s for interface %d = %v, want %v", tt.metric, tt.ifid, got, tt.want)
+		}
+		if resets := testutil.ToFloat64(ntopng_counter_resets.WithLabelValues(tt.metric, fmt.Sprintf("%d", tt.ifid))); resets != 0 {
+			t.Errorf("%s for interface %d counted %v resets, want 0", tt.metric, tt.ifid, resets)
+		}
+	}
+}
+
+func TestScraperCounterDeltas(t *testing.T) {
+	conf, registry := newScraperTestConfig(t)
+	client := &fakeNtopClient{
+		enumerations: [][]int{{0, 1, 2}},
+		responses: map[int][]string{
+			0: {zmqStatsBody(100, 10, 1, 3), zmqStatsBody(250, 12, 1, 4), zmqStatsBody(400, 20, 2, 5)},
+			// nothing new between the first two cycles
+			1: {zmqStatsBody(5, 0, 0, 1), zmqStatsBody(5, 0, 0, 1), zmqStatsBody(20, 3, 0, 2)},
+			// ntopng restarted before the second cycle
+			2: {zmqStatsBody(500, 50, 5, 2), zmqStatsBody(50, 5, 0, 2), zmqStatsBody(80, 6, 1, 2)},
+		},
+	}
+
+	// three cycles of three interfaces
+	runScraper(t, conf, client, queriedAtLeast(9))
+
+	tests := []struct {
+		ifid       int
+		metric     string
+		want       float64
+		wantResets float64
+	}{
+		{ifid: 0, metric: "zmq_msg_rcvd", want: 400},
+		{ifid: 0, metric: "dropped_flows", want: 20},
+		{ifid: 0, metric: "zmq_msg_drops", want: 2},
+		{ifid: 1, metric: "zmq_msg_rcvd", want: 20},
+		{ifid: 1, metric: "dropped_flows", want: 3},
+		{ifid: 1, metric: "zmq_msg_drops", want: 0},
+		// after a reset ntopng's whole new value is added: 500 + 50 + (80 - 50)
+		{ifid: 2, metric: "zmq_msg_rcvd", want: 580, wantResets: 1},
+		{ifid: 2, metric: "dropped_flows", want: 56, wantResets: 1},
+		{ifid: 2, metric: "zmq_msg_drops", want: 6, wantResets: 1},
+	}
+
+	for _, tt := range tests {
+		if got := counterValue(t, tt.metric, tt.ifid); got != tt.want {
+			t.Errorf("%s for interface %d = %v, want %v", tt.metric, tt.ifid, got, tt.want)
+		}
+		if resets := testutil.ToFloat64(ntopng_counter_resets.WithLabelValues(tt.metric, fmt.Sprintf("%d", tt.ifid))); resets != tt.wantResets {
+			t.Errorf("%s for interface %d counted %v resets, want %v", tt.metric, tt.ifid, resets, tt.wantResets)
+		}
+	}
+
+	// zmq_avg_msg_flows is a gauge and takes ntopng's latest value as is
+	hostname, _ := os.Hostname()
+	if got := testutil.ToFloat64(zmqMetrics["zmq_avg_msg_flows"].gauge.WithLabelValues(hostname, "0")); got != 5 {
+		t.Errorf("zmq_avg_msg_flows for interface 0 = %v, want 5", got)
+	}
+
+	// the counters are exported through the registry the metrics server uses
+	n, err := testutil.GatherAndCount(registry, "nettel_zmq_rcvd_messages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("registry has %d nettel_zmq_rcvd_messages series, want 3", n)
+	}
+	if got := testutil.ToFloat64(ntopng_scraped_interfaces); got != 3 {
+		t.Errorf("ntopng_scraped_interfaces = %v, want 3", got)
+	}
+}
+
+func TestScraperForgetsRemovedInterfaces(t *testing.T) {
+	conf, registry := newScraperTestConfig(t)
+	conf.enumerationInterval = time.Millisecond
+
+	// interface 1 goes away after a few enumerations, giving the scraper a
+	// chance to scrape it first
+	var enumerations [][]int
+	for range 50 {
+		enumerations = append(enumerations, []int{0, 1})
+	}
+	client := &fakeNtopClient{
+		enumerations: append(enumerations, []int{0}),
+		responses: map[int][]string{
+			0: {zmqStatsBody(1000, 100, 10, 3)},
+			1: {zmqStatsBody(10, 1, 0, 3)},
+		},
+	}
+
+	// stop once interface 0 has been scraped twice since the last scrape of
+	// interface 1
+	withoutRemoved := func(queried []int) bool {
+		last := slices.Index(queried, 1)
+		if last < 0 {
+			return false
+		}
+		for i, ifid := range queried {
+			if ifid == 1 {
+				last = i
+			}
+		}
+		return len(queried)-last-1 >= 2
+	}
+
+	runScraper(t, conf, client, withoutRemoved)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "ifid" && label.GetValue() == "1" {
+					t.Errorf("%s still has a series for interface 1", family.GetName())
+				}
+			}
+		}
+	}
+	if got := counterValue(t, "zmq_msg_rcvd", 0); got != 1000 {
+		t.Errorf("zmq_msg_rcvd for interface 0 = %v, want 1000", got)
+	}
+}
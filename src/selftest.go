@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// selftestPath runs an end-to-end check against ntopng when
+// ENABLE_SELFTEST_ENDPOINT is set
+const selftestPath = "/selftest"
+
+// selftestInterface is the outcome of querying one interface during a self-test
+type selftestInterface struct {
+	Ifid    int                `json:"ifid"`
+	Ifname  string             `json:"ifname"`
+	Metrics map[string]float64 `json:"metrics"`
+	Error   string             `json:"error,omitempty"`
+}
+
+// selftestResult is the JSON summary /selftest answers with
+type selftestResult struct {
+	OK             bool                `json:"ok"`
+	ElapsedSeconds float64             `json:"elapsed_seconds"`
+	Interfaces     []selftestInterface `json:"interfaces"`
+	Errors         []string            `json:"errors"`
+}
+
+// runSelftest enumerates the ntopng interfaces and queries each of them once,
+// the way a scrape cycle would but without retries and without feeding the
+// exporter's counters. Every supported metric that is enabled must be present
+// for an interface to pass.
+func runSelftest(c config) selftestResult {
+	start := time.Now()
+	result := selftestResult{Interfaces: []selftestInterface{}, Errors: []string{}}
+
+	var metricNames []string
+	for metricName := range zmqMetrics {
+		if !c.disabledMetrics[metricName] {
+			metricNames = append(metricNames, metricName)
+		}
+	}
+	sort.Strings(metricNames)
+
+	// a self-test must not replace the scraper's interface names or feed the
+	// shared circuit breaker, so it enumerates and queries without either
+	interfaces, names, err := listInterfaces(c, nil)
+	if err != nil {
+		result.Errors = append(result.Errors, fmt.Sprintf("enumerating interfaces: %v", err))
+	} else if len(interfaces) == 0 {
+		result.Errors = append(result.Errors, "ntopng listed no interfaces")
+	}
+
+	for _, ifid := range interfaces {
+		iface := selftestInterface{Ifid: ifid, Ifname: names[ifid], Metrics: make(map[string]float64)}
+
+		body, err := queryInterfaceData(c, ifid, nil)
+		if err == nil {
+			if rc := gjson.Get(body, "rc"); rc.Exists() && rc.Int() != 0 {
+				err = fmt.Errorf("ntopng returned rc=%d (%s)", rc.Int(), gjson.Get(body, "rc_str").String())
+			}
+		}
+		if err == nil {
+			for _, metricName := range metricNames {
+				val, _ := lookupStat(body, c.statsBasePath, metricField(c, metricName))
+				if val.Exists() {
+					iface.Metrics[metricName] = val.Float()
+				}
+			}
+			if missing := missingFields(c, body, metricNames); len(missing) > 0 {
+				err = fmt.Errorf("response is missing %s", strings.Join(missing, ", "))
+			}
+		}
+
+		if err != nil {
+			iface.Error = err.Error()
+			result.Errors = append(result.Errors, fmt.Sprintf("interface %d: %v", ifid, err))
+		}
+		result.Interfaces = append(result.Interfaces, iface)
+	}
+
+	result.OK = len(result.Errors) == 0
+	result.ElapsedSeconds = time.Since(start).Seconds()
+	return result
+}
+
+// selftestHandler runs a self-test for every request. It answers 200 when the
+// self-test passed and 503 otherwise, with the summary as JSON either way.
+func selftestHandler(c config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := runSelftest(c)
+
+		w.Header().Set("Content-Type", "application/json")
+		if !result.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ntopng authentication modes selectable with NTOPNG_AUTH_MODE
+const (
+	// authModeBasic sends HTTP basic auth on every request. This is the
+	// original behavior.
+	authModeBasic = "basic"
+	// authModeCookie logs in once through ntopng's login form and sends the
+	// session cookie it hands back, for setups that don't accept basic auth.
+	authModeCookie = "cookie"
+)
+
+// ntopngLoginPath is where ntopng's login page (/lua/login.lua) posts its form
+const ntopngLoginPath = "/authorize.html"
+
+// ntopngSessionCookie is the name of the cookie ntopng sets on login
+const ntopngSessionCookie = "session"
+
+// errLoginFailed is returned when ntopng doesn't hand out a session cookie for
+// our credentials
+var errLoginFailed = fmt.Errorf("%w: ntopng login failed; check NTOPNG_USERNAME and NTOPNG_PASSWORD", errAuth)
+
+// errSessionExpired is returned when ntopng turns a request away for want of a
+// valid session
+var errSessionExpired = fmt.Errorf("%w: ntopng session expired", errAuth)
+
+// ntopngSession performs the cookie login flow. The cookie itself lives in the
+// cookie jar of ntopngHTTPClient, so every request picks it up.
+type ntopngSession struct {
+	loginURL  string
+	username  string
+	password  string
+	userAgent string
+
+	mu sync.Mutex
+	// generation counts successful logins, so a request turned away with an
+	// expired session can tell whether someone has logged in again since
+	generation uint64
+	// flight is the login in progress, if any
+	flight *loginFlight
+}
+
+// loginFlight is a single login that concurrent callers wait on together
+type loginFlight struct {
+	done       chan struct{}
+	generation uint64
+	err        error
+}
+
+func newNtopngSession(c config) *ntopngSession {
+	return &ntopngSession{
+		loginURL:  c.ntopngURL.JoinPath(ntopngLoginPath).String(),
+		username:  c.ntopngUsername,
+		password:  c.ntopngPassword,
+		userAgent: c.userAgent,
+	}
+}
+
+// login makes sure we hold a session newer than stale and returns its
+// generation. Pass 0 to take whatever session we have, or the generation a
+// request was sent with when ntopng said it had expired. Concurrent callers
+// share a single login, and s.mu is not held while it is in flight. breaker is
+// consulted and fed as doNtopRequestWithBreaker does.
+func (s *ntopngSession) login(ctx context.Context, stale uint64, breaker *circuitBreaker) (uint64, error) {
+	s.mu.Lock()
+	if s.generation > stale {
+		generation := s.generation
+		s.mu.Unlock()
+		return generation, nil
+	}
+
+	f := s.flight
+	if f == nil {
+		f = &loginFlight{done: make(chan struct{})}
+		s.flight = f
+		s.mu.Unlock()
+
+		err := s.post(ctx, breaker)
+
+		s.mu.Lock()
+		if err == nil {
+			s.generation += 1
+		}
+		f.generation, f.err = s.generation, err
+		s.flight = nil
+		s.mu.Unlock()
+		close(f.done)
+	} else {
+		s.mu.Unlock()
+	}
+
+	select {
+	case <-f.done:
+		return f.generation, f.err
+	case <-ctx.Done():
+		return 0, fmt.Errorf("ntopng login: %w", ctx.Err())
+	}
+}
+
+// post sends our credentials to ntopng's login form. Like any other request to
+// ntopng it waits for the rate limiter, is refused while the breaker is open,
+// and is bounded by NTOPNG_ATTEMPT_TIMEOUT_SECONDS.
+func (s *ntopngSession) post(ctx context.Context, breaker *circuitBreaker) error {
+	if ntopngLimiter != nil {
+		err := ntopngLimiter.Wait(ctx)
+		if err != nil {
+			return fmt.Errorf("ntopng login: %w", err)
+		}
+	}
+
+	probe, err := breaker.allow()
+	if err != nil {
+		return fmt.Errorf("ntopng login: %w", err)
+	}
+
+	if ntopngAttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ntopngAttemptTimeout)
+		defer cancel()
+	}
+
+	form := url.Values{}
+	form.Set("user", s.username)
+	form.Set("password", s.password)
+	form.Set("referer", "/")
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", s.loginURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", s.userAgent)
+	req.Header.Set(requestIDHeader, newCorrelationID())
+
+	resp, err := ntopngHTTPClient.Do(req)
+	// a rejected login still means ntopng is up and answering
+	breaker.record(probe, err)
+	if err != nil {
+		return fmt.Errorf("ntopng login: %w", err)
+	}
+	resp.Body.Close()
+
+	// ntopng answers a login with a redirect either way; only a successful one
+	// sets the session cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == ntopngSessionCookie && cookie.Value != "" {
+			return nil
+		}
+	}
+
+	return errLoginFailed
+}
+
+// isSessionExpired reports whether ntopng turned a request away for want of a
+// valid session. It redirects to the login page rather than answering 401,
+// which is why the cookie-mode client doesn't follow redirects.
+func isSessionExpired(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusFound
+}
+
+// sendNtopRequest sends req on the shared client. In cookie mode the session
+// cookie replaces basic auth, and errSessionExpired is returned if ntopng
+// didn't accept it; doNtopRequestWithBreaker logs in again and resends.
+func sendNtopRequest(req *http.Request) (*http.Response, error) {
+	if ntopngAuth == nil {
+		return ntopngHTTPClient.Do(req)
+	}
+
+	req.Header.Del("Authorization")
+
+	resp, err := ntopngHTTPClient.Do(req)
+	if err != nil || !isSessionExpired(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	return nil, errSessionExpired
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newLoginServer fakes ntopng's login form, handing out a session cookie for
+// admin/admin. It counts the logins it sees and the User-Agents they carry.
+func newLoginServer(t *testing.T, logins *atomic.Int64, userAgents *sync.Map) *url.URL {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins.Add(1)
+		userAgents.Store(r.UserAgent(), true)
+		// give concurrent callers time to pile up behind the login
+		time.Sleep(20 * time.Millisecond)
+
+		if r.PostFormValue("user") == "admin" && r.PostFormValue("password") == "admin" {
+			http.SetCookie(w, &http.Cookie{Name: ntopngSessionCookie, Value: "s1"})
+		}
+		w.Header().Set("Location", "/")
+		w.WriteHeader(http.StatusFound)
+	}))
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSessionLogin(t *testing.T) {
+	var logins atomic.Int64
+	var userAgents sync.Map
+	ntopngURL := newLoginServer(t, &logins, &userAgents)
+
+	conf := config{
+		ntopngURL:      ntopngURL,
+		ntopngUsername: "admin",
+		ntopngPassword: "admin",
+		authMode:       authModeCookie,
+		userAgent:      "ntopng-prom-exporter/test",
+	}
+	ntopngHTTPClient = newNtopngHTTPClient(conf)
+	session := newNtopngSession(conf)
+	ctx := context.Background()
+
+	// concurrent callers share a single login
+	var wg sync.WaitGroup
+	generations := make([]uint64, 10)
+	errs := make([]error, len(generations))
+	for i := range generations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			generations[i], errs[i] = session.login(ctx, 0, nil)
+		}()
+	}
+	wg.Wait()
+
+	for i := range generations {
+		if errs[i] != nil {
+			t.Fatalf("login returned %v", errs[i])
+		}
+		if generations[i] != 1 {
+			t.Errorf("login returned generation %d, want 1", generations[i])
+		}
+	}
+	if n := logins.Load(); n != 1 {
+		t.Errorf("ntopng saw %d logins, want 1", n)
+	}
+	if _, ok := userAgents.Load(conf.userAgent); !ok {
+		t.Errorf("login didn't send User-Agent %q", conf.userAgent)
+	}
+
+	// an existing session is reused
+	generation, err := session.login(ctx, 0, nil)
+	if err != nil || generation != 1 {
+		t.Errorf("login(0) = %d, %v, want 1, nil", generation, err)
+	}
+
+	// an expired session is replaced, but only once
+	for range 2 {
+		generation, err = session.login(ctx, 1, nil)
+		if err != nil || generation != 2 {
+			t.Errorf("login(1) = %d, %v, want 2, nil", generation, err)
+		}
+	}
+	if n := logins.Load(); n != 2 {
+		t.Errorf("ntopng saw %d logins, want 2", n)
+	}
+}
+
+func TestSessionLoginRejected(t *testing.T) {
+	var logins atomic.Int64
+	var userAgents sync.Map
+	ntopngURL := newLoginServer(t, &logins, &userAgents)
+
+	conf := config{
+		ntopngURL:      ntopngURL,
+		ntopngUsername: "admin",
+		ntopngPassword: "wrong",
+		authMode:       authModeCookie,
+	}
+	ntopngHTTPClient = newNtopngHTTPClient(conf)
+	session := newNtopngSession(conf)
+
+	_, err := session.login(context.Background(), 0, nil)
+	if !errors.Is(err, errLoginFailed) {
+		t.Fatalf("login returned %v, want errLoginFailed", err)
+	}
+	if !isAuthFailure(err) {
+		t.Errorf("isAuthFailure(%v) = false, want true", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsJSONPath serves the latest scraped values when ENABLE_STATS_JSON is set
+const statsJSONPath = "/stats.json"
+
+// interfaceStats is the latest set of values scraped from one ntopng interface
+type interfaceStats struct {
+	Ifid      int                `json:"ifid"`
+	Ifname    string             `json:"ifname"`
+	ScrapedAt time.Time          `json:"scraped_at"`
+	Metrics   map[string]float64 `json:"metrics"`
+}
+
+// latestStats holds the values from the last successful scrape of each
+// interface, for /stats.json. Entries are replaced wholesale, so a metric
+// missing from the last response is missing here too.
+var (
+	latestStatsMu sync.RWMutex
+	latestStats   = make(map[int]interfaceStats)
+)
+
+func setLatestStats(ifid int, metrics map[string]float64) {
+	latestStatsMu.Lock()
+	defer latestStatsMu.Unlock()
+	latestStats[ifid] = interfaceStats{
+		Ifid:      ifid,
+		Ifname:    interfaceName(ifid),
+		ScrapedAt: time.Now(),
+		Metrics:   metrics,
+	}
+}
+
+// statsJSONHandler returns the latest scraped per-interface values as JSON, for
+// consumers that don't want to parse the Prometheus text format.
+func statsJSONHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname, _ := os.Hostname()
+
+		latestStatsMu.RLock()
+		interfaces := make([]interfaceStats, 0, len(latestStats))
+		for _, stats := range latestStats {
+			interfaces = append(interfaces, stats)
+		}
+		latestStatsMu.RUnlock()
+
+		sort.Slice(interfaces, func(i, j int) bool { return interfaces[i].Ifid < interfaces[j].Ifid })
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Hostname   string           `json:"hostname"`
+			Interfaces []interfaceStats `json:"interfaces"`
+		}{hostname, interfaces})
+	})
+}
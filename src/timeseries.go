@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	ntopng_timeseries_latest = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntopng_timeseries_latest",
+		Help: "Latest datapoint of an ntopng timeseries, as returned by ts.lua.",
+	}, []string{"hostname", "ifid", "schema", "series"}) // labels for the metrics
+)
+
+const endpointTimeseries = "timeseries"
+
+// timeseriesWindow is how far back we ask ntopng for datapoints. It only needs
+// to be long enough to contain at least one datapoint at ntopng's own
+// timeseries resolution.
+const timeseriesWindow = 5 * time.Minute
+
+func queryNtopTimeseries(c config, ifid int, schema string) (string, error) {
+	// https://www.ntop.org/guides/ntopng/api/rest/api_v2.html (timeseries)
+	now := time.Now()
+	params := url.Values{}
+	params.Set("ts_schema", schema)
+	params.Set("ts_query", fmt.Sprintf("ifid:%d", ifid))
+	params.Set("epoch_begin", strconv.FormatInt(now.Add(-timeseriesWindow).Unix(), 10))
+	params.Set("epoch_end", strconv.FormatInt(now.Unix(), 10))
+
+	var url = ntopngAPIURL(c, "/get/timeseries/ts.lua", params)
+
+	req, _ := http.NewRequest("GET", url, nil)
+
+	req.Header.Set("Authorization", "Basic "+c.basicAuthenticationToken)
+	req.Header.Set("User-Agent", c.userAgent)
+
+	resp, err := doNtopRequest(req, endpointTimeseries)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := readResponseBody(resp, c.maxResponseBytes, endpointTimeseries)
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// latestDatapoint returns the last numeric value in a series' data array.
+// ntopng pads series with nulls for intervals it hasn't written yet, so we walk
+// back from the end.
+func latestDatapoint(data gjson.Result) (float64, bool) {
+	points := data.Array()
+	for i := len(points) - 1; i >= 0; i-- {
+		if points[i].Type == gjson.Number {
+			return points[i].Float(), true
+		}
+	}
+	return 0, false
+}
+
+// scrapeTimeseries exports the latest datapoint of each configured timeseries
+// schema for ifid. Failures are logged and skipped; timeseries are best effort
+// and should never hold up the counter metrics.
+func scrapeTimeseries(c config, hostname string, ifid int) {
+	for _, schema := range c.timeseries {
+		body, err := queryNtopTimeseries(c, ifid, schema)
+		if err != nil {
+			errorLog.Printf("timeseries_error", "Error: Unable to query ntopng timeseries %s for interface %d: %v", schema, ifid, err)
+			continue
+		}
+
+		series := gjson.Get(body, "rsp.series")
+		if !series.Exists() {
+			errorLog.Printf("timeseries_no_series", "Error: ntopng timeseries %s for interface %d has no series. Skipping", schema, ifid)
+			continue
+		}
+
+		series.ForEach(func(key, value gjson.Result) bool {
+			// newer ntopng releases name series by id, older ones by label
+			name := value.Get("id").String()
+			if name == "" {
+				name = value.Get("label").String()
+			}
+			if name == "" {
+				name = key.String()
+			}
+
+			latest, ok := latestDatapoint(value.Get("data"))
+			if ok {
+				ntopng_timeseries_latest.WithLabelValues(hostname, fmt.Sprintf("%d", ifid), schema, name).Set(latest)
+			}
+			return true // keep iterating
+		})
+	}
+}